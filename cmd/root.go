@@ -18,17 +18,31 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/elastic/aws-ami-share/common"
 	"github.com/elastic/aws-ami-share/core"
+	"github.com/elastic/aws-ami-share/utils"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 const (
 	CLIName    = "ami-share"
 	CLIExample = "AWS_SDK_LOAD_CONFIG=true AWS_PROFILE=staging-ami ./ami-share -v -c example.yaml -p plan.yaml"
+
+	// Exit codes with --detailed-exitcode. diff always exits with ExitChanges when the plans differ
+	ExitNoChanges       = 0
+	ExitError           = 1
+	ExitChanges         = 2
+	ExitValidationError = 3
+	ExitPartialApply    = 4
+	// Exit code of a command interrupted by SIGINT or SIGTERM, with or without --detailed-exitcode
+	ExitInterrupted = 130
 )
 
 func RootCmd(version, hash, date string) {
@@ -36,6 +50,13 @@ func RootCmd(version, hash, date string) {
 	var configFile string
 	var verbose bool
 	var params common.ShareParams
+	var detailedExitCode bool
+	var retryFlags common.RetryPolicy
+	var pendingChanges bool
+	// the plans given to diff differ
+	var plansDiffer bool
+	// Canceled on interrupt once plan or apply starts working on the accounts
+	ctx := context.Background()
 
 	var rootCmd = &cobra.Command{
 		Use: CLIName,
@@ -46,44 +67,84 @@ func RootCmd(version, hash, date string) {
 	}
 
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Enables debug output.")
+	rootCmd.PersistentFlags().BoolVarP(&params.Quiet, "quiet", "q", false,
+		"Only outputs warnings and errors, without the plan summary.")
+	rootCmd.PersistentFlags().BoolVar(&params.NoColor, "no-color", false,
+		"Disables colors in the plan summary.")
+	rootCmd.PersistentFlags().BoolVar(&detailedExitCode, "detailed-exitcode", false,
+		fmt.Sprintf("(optional) Exits with %d if there are no changes, %d if changes are pending, %d on errors, %d on validation errors and %d if some actions failed while applying.",
+			ExitNoChanges, ExitChanges, ExitError, ExitValidationError, ExitPartialApply))
 	rootCmd.PersistentFlags().BoolVar(&params.NoDryRun, "no-dry-run", false,
 		"If specified, it shares AMIs. Otherwise it just list target candidates in plan file.")
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "",
-		"(required) Path to the config file.")
+		"(required, except for render and diff) Path to the config file.")
 	rootCmd.PersistentFlags().StringVarP(&params.PlanFile, "plan", "p", "",
-		"(required) Path to output file for plan.")
+		"(required, except for apply, render and diff) Path to output file for plan.")
+	rootCmd.PersistentFlags().StringVar(&params.PlanFormat, "plan-format", core.PlanFormatYAML,
+		fmt.Sprintf("(optional) Format of the plan file: %v.", core.PlanFormats()))
+	rootCmd.PersistentFlags().StringVar(&params.PlanSigningKey, "plan-signing-key", "",
+		"(optional) Path to a PEM encoded ed25519 private key for signing the plan.")
 	rootCmd.PersistentFlags().BoolVar(&params.ShareSnapshots, "share-snapshots", false,
 		"(optional) Whether to share snapshots attached to AMIs.")
+	rootCmd.PersistentFlags().IntVar(&params.Concurrency, "concurrency", core.DefaultConcurrency,
+		"(optional) Number of accounts and regions processed at once when applying the plan.")
+	rootCmd.PersistentFlags().IntVar(&params.RegionConcurrency, "region-concurrency", core.DefaultRegionConcurrency,
+		"(optional) Number of tasks run at once in each region when applying the plan, to respect EC2 API rate limits.")
+	rootCmd.PersistentFlags().BoolVar(&params.AtomicPerAccount, "atomic-per-account", false,
+		"(optional) Revoke the permissions and remove the marker tags added to an account by the apply if any step of the account fails.")
+	rootCmd.PersistentFlags().StringVar(&params.JournalFile, "journal", "",
+		fmt.Sprintf("(optional) Path to output file for the journal of the completed steps of the apply. (default PLAN_FILE%s)", core.JournalSuffix))
+	rootCmd.PersistentFlags().StringVar(&params.ReportFile, "report", "",
+		"(optional) Path to output file for the run report of the apply, in the format of the plan. Interrupted applies write it to PLAN_FILE.report without it.")
+	rootCmd.PersistentFlags().IntVar(&retryFlags.MaxAttempts, "retry-max-attempts", 0,
+		fmt.Sprintf("(optional) Attempts of an action failing with throttling or transient errors, overriding the config. (default %d)", common.DefaultRetryMaxAttempts))
+	rootCmd.PersistentFlags().StringVar(&retryFlags.MaxElapsed, "retry-max-elapsed", "",
+		fmt.Sprintf("(optional) Total time of an action, retries included, overriding the config. (default %s)", common.DefaultRetryMaxElapsed))
+	rootCmd.PersistentFlags().StringVar(&params.MFAToken, "mfa-token", "",
+		"(optional) MFA token code for the roles requiring MFA. Prompted on stdin when needed otherwise.")
+	rootCmd.PersistentFlags().StringVar(&params.KMSAccess, "kms-access", core.KMSAccessNone,
+		fmt.Sprintf("(optional) Access management of target accounts to KMS keys of encrypted AMIs: %v.", core.KMSAccessModes()))
 
-	if err := rootCmd.MarkPersistentFlagRequired("config"); err != nil {
-		log.Infof("Failed with error: %v", err)
-		os.Exit(1)
-	}
-	if err := rootCmd.MarkPersistentFlagRequired("plan"); err != nil {
-		log.Infof("Failed with error: %v", err)
-		os.Exit(1)
-	}
-
-	rootCmd.PreRun = func(cmd *cobra.Command, args []string) {
+	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
 		log.SetLevel(log.InfoLevel)
 		if verbose {
 			log.SetLevel(log.DebugLevel)
+		} else if params.Quiet {
+			log.SetLevel(log.WarnLevel)
 		}
 	}
 
-	rootCmd.RunE = func(cmd *cobra.Command, args []string) error {
+	// Load and validate the config, then validate the accounts of the config
+	initialize := func() (core.AWSShareAMI, error) {
 		logger := log.WithFields(log.Fields{
 			"context":   "share-command",
 			"operation": "validation",
 		})
 
+		if configFile == "" {
+			return core.AWSShareAMI{}, &core.ValidationError{Err: errors.New("required flag(s) \"config\" not set")}
+		}
+
+		if !contains(core.KMSAccessModes(), params.KMSAccess) {
+			return core.AWSShareAMI{}, &core.ValidationError{Err: errors.New(fmt.Sprintf("invalid --kms-access [%s]: expected one of %v", params.KMSAccess, core.KMSAccessModes()))}
+		}
+
+		if params.MFAToken != "" && !utils.IsMFAToken(params.MFAToken) {
+			return core.AWSShareAMI{}, &core.ValidationError{Err: errors.New("invalid --mfa-token: expected 6 digits")}
+		}
+
+		if !contains(core.PlanFormats(), params.PlanFormat) {
+			return core.AWSShareAMI{}, &core.ValidationError{Err: errors.New(fmt.Sprintf("invalid --plan-format [%s]: expected one of %v", params.PlanFormat, core.PlanFormats()))}
+		}
+
 		if config, err := common.LoadConfig(configFile); err != nil {
 			logger.Errorf("Failed to parse config file: %v", err)
-			return err
+			return core.AWSShareAMI{}, &core.ValidationError{Err: err}
 		} else {
 			logger.Info("Validating config")
+			config.Retry.Override(retryFlags)
 			if err := config.Validate(); err != nil {
-				return err
+				return core.AWSShareAMI{}, &core.ValidationError{Err: err}
 			}
 			params.Config = config
 		}
@@ -91,18 +152,245 @@ func RootCmd(version, hash, date string) {
 		logger.Info("Initializing")
 		shareAMI, err := core.NewAWSShareAMI(&params)
 		if err != nil {
-			return err
+			return shareAMI, err
+		}
+
+		logger.Info("Validating credential sources")
+		if err := shareAMI.ValidateCredentialSources(ctx); err != nil {
+			return shareAMI, &core.ValidationError{Err: err}
 		}
 
 		logger.Info("Validating accounts")
-		if err := shareAMI.ValidateAccounts(); err != nil {
+		if err := shareAMI.ValidateAccounts(ctx); err != nil {
+			return shareAMI, &core.ValidationError{Err: err}
+		}
+
+		logger.Info("Validating KMS keys")
+		if err := shareAMI.ValidateKMSKeys(ctx); err != nil {
+			return shareAMI, &core.ValidationError{Err: err}
+		}
+		return shareAMI, nil
+	}
+
+	rootCmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if params.PlanFile == "" {
+			return &core.ValidationError{Err: errors.New("required flag(s) \"plan\" not set")}
+		}
+		shareAMI, err := initialize()
+		if err != nil {
 			return err
 		}
-		return shareAMI.Run()
+		if params.JournalFile == "" {
+			params.JournalFile = params.PlanFile + core.JournalSuffix
+		}
+		ctx = interruptContext()
+		plan, err := shareAMI.Run(ctx)
+		if err != nil {
+			return err
+		}
+		pendingChanges = !params.NoDryRun && hasChanges(plan)
+		return nil
 	}
+
+	var render string
+	var planCmd = &cobra.Command{
+		Use:     "plan",
+		Short:   "Writes the plan for sharing AMIs, without sharing them.",
+		Example: fmt.Sprintf("%s plan -c example.yaml -p plan.yaml", CLIName),
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if params.PlanFile == "" {
+				return &core.ValidationError{Err: errors.New("required flag(s) \"plan\" not set")}
+			}
+			shareAMI, err := initialize()
+			if err != nil {
+				return err
+			}
+			ctx = interruptContext()
+			plan, err := shareAMI.Plan(ctx)
+			if err != nil {
+				return err
+			}
+			if err := shareAMI.WritePlan(plan); err != nil {
+				return err
+			}
+			pendingChanges = hasChanges(plan)
+			if render != "" {
+				return core.RenderPlan(os.Stdout, plan.Document(), render)
+			}
+			return shareAMI.PrintSummary(plan)
+		},
+	}
+
+	planCmd.Flags().StringVar(&render, "render", "",
+		fmt.Sprintf("(optional) Prints the plan rendered as one of %v, instead of the summary.", core.RenderFormats()))
+
+	var resume string
+	var applyCmd = &cobra.Command{
+		Use:     "apply PLAN_FILE",
+		Short:   "Shares AMIs according to a plan previously written by the plan command.",
+		Example: fmt.Sprintf("%s apply -c example.yaml plan.yaml", CLIName),
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			params.PlanFile = args[0]
+			params.NoDryRun = true
+			if resume != "" {
+				params.JournalFile = resume
+				params.Resume = true
+			} else if params.JournalFile == "" {
+				params.JournalFile = params.PlanFile + core.JournalSuffix
+			}
+			shareAMI, err := initialize()
+			if err != nil {
+				return err
+			}
+			ctx = interruptContext()
+			plan, err := shareAMI.LoadPlan(ctx, params.PlanFile)
+			if err != nil {
+				return err
+			}
+			return shareAMI.Apply(ctx, plan)
+		},
+	}
+
+	applyCmd.Flags().StringVar(&resume, "resume", "",
+		"(optional) Path to the journal of a previous apply of the plan: its completed steps are skipped.")
+	applyCmd.Flags().BoolVar(&params.AllowStale, "allow-stale", false,
+		"(optional) Apply the plan even if its AMIs changed since it was written.")
+	applyCmd.Flags().StringVar(&params.PlanPublicKey, "plan-public-key", "",
+		"(optional) Path to a PEM encoded ed25519 public key for verifying the plan signature.")
+	applyCmd.Flags().BoolVar(&params.RequireSignedPlan, "require-signed-plan", false,
+		"(optional) Reject plans without a valid signature.")
+
+	var renderFormat string
+	var renderOutput string
+	var renderCmd = &cobra.Command{
+		Use:     "render PLAN_FILE",
+		Short:   "Renders a plan file for reviews, without accessing AWS.",
+		Example: fmt.Sprintf("%s render plan.yaml --format html -o plan.html", CLIName),
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !contains(core.RenderFormats(), renderFormat) {
+				return errors.New(fmt.Sprintf("invalid --format [%s]: expected one of %v", renderFormat, core.RenderFormats()))
+			}
+			document, _, err := core.ReadPlanDocument(args[0])
+			if err != nil {
+				return err
+			}
+			if err := document.Verify(params.PlanPublicKey, false); err != nil {
+				return errors.New(fmt.Sprintf("plan %s failed verification: %v", args[0], err))
+			}
+
+			if renderOutput == "" {
+				return core.RenderPlan(os.Stdout, *document, renderFormat)
+			}
+			output, err := os.Create(renderOutput)
+			if err != nil {
+				return err
+			}
+			defer output.Close()
+			return core.RenderPlan(output, *document, renderFormat)
+		},
+	}
+
+	renderCmd.Flags().StringVar(&renderFormat, "format", core.RenderFormatMarkdown,
+		fmt.Sprintf("(optional) Format of the rendering: %v.", core.RenderFormats()))
+	renderCmd.Flags().StringVarP(&renderOutput, "output", "o", "",
+		"(optional) Path to output file for the rendering. Defaults to the standard output.")
+	renderCmd.Flags().StringVar(&params.PlanPublicKey, "plan-public-key", "",
+		"(optional) Path to a PEM encoded ed25519 public key for verifying the plan signature.")
+
+	var diffFormat string
+	var versionTag string
+	var diffCmd = &cobra.Command{
+		Use:     "diff OLD_PLAN_FILE NEW_PLAN_FILE",
+		Short:   fmt.Sprintf("Reports the AMIs added, removed or replaced between two plans. Exits with %d if the plans differ.", ExitChanges),
+		Example: fmt.Sprintf("%s diff old-plan.yaml new-plan.yaml --format json", CLIName),
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !contains(core.DiffFormats(), diffFormat) {
+				return errors.New(fmt.Sprintf("invalid --format [%s]: expected one of %v", diffFormat, core.DiffFormats()))
+			}
+			var documents []*core.PlanDocument
+			for _, path := range args {
+				document, _, err := core.ReadPlanDocument(path)
+				if err != nil {
+					return err
+				}
+				if err := document.Verify("", false); err != nil {
+					return errors.New(fmt.Sprintf("plan %s failed verification: %v", path, err))
+				}
+				documents = append(documents, document)
+			}
+
+			diffs := core.DiffPlans(documents[0], documents[1], versionTag)
+			if err := core.WriteDiff(os.Stdout, diffs, diffFormat); err != nil {
+				return err
+			}
+			plansDiffer = len(diffs) > 0
+			return nil
+		},
+	}
+
+	diffCmd.Flags().StringVar(&diffFormat, "format", core.DiffFormatText,
+		fmt.Sprintf("(optional) Format of the output: %v.", core.DiffFormats()))
+	diffCmd.Flags().StringVar(&versionTag, "version-tag", "",
+		"(optional) Tag of the AMIs holding their version. Defaults to names and creation dates.")
+
+	rootCmd.AddCommand(planCmd, applyCmd, renderCmd, diffCmd)
 	err := rootCmd.Execute()
 	if err != nil {
 		log.Infof("Failed with error: %v", err)
-		os.Exit(1)
+		if ctx.Err() != nil {
+			os.Exit(ExitInterrupted)
+		}
+		if detailedExitCode {
+			os.Exit(exitCode(err))
+		}
+		os.Exit(ExitError)
+	}
+	if plansDiffer || detailedExitCode && pendingChanges {
+		os.Exit(ExitChanges)
+	}
+}
+
+// Context canceled on SIGINT or SIGTERM: an apply finishes its running steps and writes its report.
+// A second signal exits at once. Installed once the config is validated, so signals received before,
+// e.g. while prompting for an MFA token, exit at once
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Warnf("Received %s: finishing the running steps, send it again to exit at once", sig)
+		cancel()
+		<-signals
+		os.Exit(ExitInterrupted)
+	}()
+	return ctx
+}
+
+func exitCode(err error) int {
+	switch err.(type) {
+	case *core.ValidationError:
+		return ExitValidationError
+	case *core.PartialApplyError:
+		return ExitPartialApply
+	}
+	return ExitError
+}
+
+func hasChanges(plan *core.AMISharePlan) bool {
+	document := plan.Document()
+	return document.HasChanges()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
+	return false
 }
@@ -19,21 +19,69 @@ package common
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
+)
+
+var (
+	sessionNamePattern = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+	externalIDPattern  = regexp.MustCompile(`^[\w+=,.@:/-]+$`)
+	mfaSerialPattern   = regexp.MustCompile(`^[\w+=/:,.@-]{9,256}$`)
+)
+
+const (
+	OrganizationARNPrefix       = "organization"
+	OrganizationalUnitARNPrefix = "ou"
+	DefaultProtectTag           = "UnDeletable=true"
+
+	// Bounds of the duration of role sessions. The maximum session duration of the role may be lower
+	MinRoleDuration = 15 * time.Minute
+	MaxRoleDuration = 12 * time.Hour
+	// AWS limits the sessions of roles assumed from another role to one hour
+	MaxChainedRoleDuration = time.Hour
+	// Roles of a chain, the role of the account included
+	MaxRoleChainLength = 5
+
+	DefaultRetryMaxAttempts = 5
+	DefaultRetryBaseDelay   = "1s"
+	DefaultRetryMaxDelay    = "30s"
+	DefaultRetryMaxElapsed  = "5m"
 )
 
 type ShareParams struct {
 	Config         *Config
 	NoDryRun       bool
 	ShareSnapshots bool
+	KMSAccess      string
 	PlanFile       string
+	PlanFormat     string
+	AllowStale     bool
+	Quiet          bool
+	NoColor        bool
+
+	Concurrency       int
+	RegionConcurrency int
+	ReportFile        string
+	JournalFile       string
+	Resume            bool
+	AtomicPerAccount  bool
+
+	PlanSigningKey    string
+	PlanPublicKey     string
+	RequireSignedPlan bool
+
+	MFAToken string
 }
 
 type Filter struct {
@@ -42,25 +90,81 @@ type Filter struct {
 	Invert   bool   `yaml:"invert"`
 }
 
+// Retention of older versions of the AMIs matching a selection.
+// Durations are Go durations with support for days, e.g. 30d
+type Retention struct {
+	KeepLatest      int    `yaml:"keep-latest,omitempty"`
+	UnshareAfter    string `yaml:"unshare-after,omitempty"`
+	DeregisterAfter string `yaml:"deregister-after,omitempty"` // Deregister in the source account
+	DeleteSnapshots bool   `yaml:"delete-snapshots,omitempty"` // Delete snapshots of deregistered AMIs
+	ProtectTag      string `yaml:"protect-tag,omitempty"`      // Key=Value tag of AMIs never unshared or deregistered
+}
+
+// Retries of the actions of an apply failing with throttling or transient errors
+type RetryPolicy struct {
+	MaxAttempts int    `yaml:"max-attempts,omitempty"` // Attempts of an action, the first one included
+	BaseDelay   string `yaml:"base-delay,omitempty"`   // Delay before the first retry, doubled on each retry
+	MaxDelay    string `yaml:"max-delay,omitempty"`
+	MaxElapsed  string `yaml:"max-elapsed,omitempty"` // Total time of an action, retries included
+}
+
 type AMISelection struct {
-	Copy    bool     `yaml:"copy"` // TODO: flag for copying AMIs not implemented yet
-	Regions []string `yaml:"regions"`
-	Filters []Filter `yaml:"filters"`
+	Copy         bool       `yaml:"copy"` // Copy AMIs into the target account after sharing them
+	KMSKeyID     string     `yaml:"kms-key-id,omitempty"`
+	SourceRegion string     `yaml:"source-region,omitempty"` // Replicate AMIs from this region into regions without a match
+	Regions      []string   `yaml:"regions"`
+	Filters      []Filter   `yaml:"filters"`
+	Retention    *Retention `yaml:"retention,omitempty"`
+}
+
+// Roles assumed in order to access an account: intermediate roles, e.g. of a hub account, then the role of the account.
+// Set as a single role or as a list of roles
+type RoleChain []string
+
+// Credentials an account is accessed with, instead of assuming its role from the default credential chain.
+// At most one source is set
+type CredentialSource struct {
+	Profile              string `yaml:"profile,omitempty"`                 // Shared config profile of the account, no role is assumed
+	BaseProfile          string `yaml:"base-profile,omitempty"`            // Shared config profile the role is assumed from
+	WebIdentityTokenFile string `yaml:"web-identity-token-file,omitempty"` // OIDC token file the role is assumed with
+	Environment          bool   `yaml:"environment,omitempty"`             // AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY the role is assumed from
 }
 
 type Account struct {
-	ID            string                  `yaml:"id"`
-	Alias         string                  `yaml:"alias"`
-	AssumeRole    string                  `yaml:"assume-role"`
-	PostShareTags map[string]string       `yaml:"post-share-tags,omitempty"`
-	Regions       []string                `yaml:"regions,omitempty"`
-	AMIs          map[string]AMISelection `yaml:"amis,omitempty"`
+	ID             string                  `yaml:"id"`
+	Alias          string                  `yaml:"alias"`
+	AssumeRole     RoleChain               `yaml:"assume-role"`
+	ExternalID     string                  `yaml:"external-id,omitempty"` // Settings of the role assumption, defaults of the AWS SDK if unset
+	SessionName    string                  `yaml:"session-name,omitempty"`
+	Duration       string                  `yaml:"duration,omitempty"`
+	SourceIdentity string                  `yaml:"source-identity,omitempty"`
+	MFASerial      string                  `yaml:"mfa-serial,omitempty"`
+	Credentials    CredentialSource        `yaml:"credentials,omitempty"`
+	KMSKeyID       string                  `yaml:"kms-key-id,omitempty"`
+	ReplicaKMSKeys map[string]string       `yaml:"replica-kms-keys,omitempty"` // KMS key by region encrypting the replicas of encrypted AMIs
+	PostShareTags  map[string]string       `yaml:"post-share-tags,omitempty"`
+	Regions        []string                `yaml:"regions,omitempty"`
+	AMIs           map[string]AMISelection `yaml:"amis,omitempty"`
+}
+
+// An AWS Organization or organizational unit to share AMIs with.
+// Sharing is done through launch permissions, so no role is assumed in the member accounts
+type Organization struct {
+	ARN     string                  `yaml:"arn"`
+	Alias   string                  `yaml:"alias"`
+	Regions []string                `yaml:"regions,omitempty"`
+	AMIs    map[string]AMISelection `yaml:"amis,omitempty"`
 }
 
 type Config struct {
-	regions        []string
-	SourceAccount  Account   `yaml:"source-account"`
-	TargetAccounts []Account `yaml:"target-accounts"`
+	regions                   []string
+	hash                      string
+	SourceAccount             Account        `yaml:"source-account"`
+	TargetAccounts            []Account      `yaml:"target-accounts"`
+	TargetOrganizations       []Organization `yaml:"organizations,omitempty"`
+	TargetOrganizationalUnits []Organization `yaml:"organizational-units,omitempty"`
+	Retry                     RetryPolicy    `yaml:"retry,omitempty"`
+	MFASerial                 string         `yaml:"mfa-serial,omitempty"` // MFA device of the accounts without their own
 }
 
 func GetEnvironmentVars() map[string]string {
@@ -99,6 +203,7 @@ func LoadConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	config.hash = fmt.Sprintf("%x", sha256.Sum256(resolvedConfigRaw.Bytes()))
 	return config, nil
 }
 
@@ -107,10 +212,26 @@ func (config *Config) Validate() error {
 		return errors.New("fields [regions] and/or [amis] not allowed on registry account")
 	}
 
-	if config.SourceAccount.AssumeRole == "" {
+	if config.SourceAccount.AssumeRole.Role() == "" && config.SourceAccount.AssumesRole() {
 		return errors.New("assume-role must be specified on source account")
 	}
 
+	if config.SourceAccount.KMSKeyID != "" {
+		return errors.New("kms-key-id not allowed on source account")
+	}
+
+	for region, kmsKeyId := range config.SourceAccount.ReplicaKMSKeys {
+		if kmsKeyId == "" {
+			return errors.New(fmt.Sprintf("replica-kms-keys: missing KMS key for region [%s]", region))
+		}
+	}
+
+	// Validated with the role settings of the accounts
+	config.InheritMFASerial()
+	if err := config.SourceAccount.ValidateRoleSettings(); err != nil {
+		return err
+	}
+
 	for _, account := range config.TargetAccounts {
 		if len(account.AMIs) < 1 {
 			return errors.New(fmt.Sprintf("account [%s] does not have any AMIs: required at least one", account.Alias))
@@ -120,22 +241,359 @@ func (config *Config) Validate() error {
 			return errors.New(fmt.Sprintf("post-share-tags not allowed here: account [%s]", account.Alias))
 		}
 
-		if account.AssumeRole == "" {
+		if len(account.ReplicaKMSKeys) > 0 {
+			return errors.New(fmt.Sprintf("replica-kms-keys not allowed here: account [%s]", account.Alias))
+		}
+
+		if account.AssumeRole.Role() == "" && account.AssumesRole() {
 			return errors.New(fmt.Sprintf("assume-role must be specified on [%s]", account.Alias))
 		}
+
+		if err := account.ValidateRoleSettings(); err != nil {
+			return err
+		}
+
+		for group, selection := range account.AMIs {
+			if selection.KMSKeyID != "" && !selection.Copy {
+				return errors.New(fmt.Sprintf("kms-key-id requires copy: account [%s], amis [%s]", account.Alias, group))
+			}
+
+			if selection.Retention != nil {
+				if err := selection.Retention.Validate(); err != nil {
+					return errors.New(fmt.Sprintf("invalid retention: account [%s], amis [%s]: %v", account.Alias, group, err))
+				}
+			}
+		}
+	}
+
+	for _, organization := range config.TargetOrganizations {
+		if err := organization.Validate(OrganizationARNPrefix); err != nil {
+			return err
+		}
+	}
+
+	for _, organizationalUnit := range config.TargetOrganizationalUnits {
+		if err := organizationalUnit.Validate(OrganizationalUnitARNPrefix); err != nil {
+			return err
+		}
+	}
+	if err := config.Retry.Validate(); err != nil {
+		return errors.New(fmt.Sprintf("invalid retry: %v", err))
 	}
 	config.CreateRoleARNs()
 
 	return nil
 }
 
+// Settings of the role assumption, as constrained by AWS STS AssumeRole
+func (account *Account) ValidateRoleSettings() error {
+	if err := account.validateCredentialSource(); err != nil {
+		return err
+	}
+
+	if len(account.AssumeRole) > MaxRoleChainLength {
+		return errors.New(fmt.Sprintf("invalid assume-role on [%s]: chains have at most %d roles", account.Alias, MaxRoleChainLength))
+	}
+	for _, role := range account.AssumeRole.Via() {
+		if !strings.HasPrefix(role, "arn:aws:iam::") {
+			return errors.New(fmt.Sprintf("invalid assume-role [%s] on [%s]: intermediate roles must be role ARNs", role, account.Alias))
+		}
+	}
+	// A role assumed twice makes a cycle, the role of the account is compared by its ARN
+	assumed := make(map[string]bool)
+	for i, role := range account.AssumeRole {
+		if i == len(account.AssumeRole)-1 && !strings.HasPrefix(role, "arn:aws:iam::") {
+			role = fmt.Sprintf("arn:aws:iam::%s:role/%s", account.ID, role)
+		}
+		if assumed[role] {
+			return errors.New(fmt.Sprintf("invalid assume-role [%s] on [%s]: role assumed twice in the chain", role, account.Alias))
+		}
+		assumed[role] = true
+	}
+
+	if account.ExternalID != "" && (!externalIDPattern.MatchString(account.ExternalID) || len(account.ExternalID) < 2 || len(account.ExternalID) > 1224) {
+		return errors.New(fmt.Sprintf("invalid external-id on [%s]: expected 2 to 1224 letters, digits or characters among +=,.@:/-", account.Alias))
+	}
+
+	if account.SessionName != "" && !sessionNamePattern.MatchString(account.SessionName) {
+		return errors.New(fmt.Sprintf("invalid session-name [%s] on [%s]: expected 2 to 64 letters, digits or characters among +=,.@-", account.SessionName, account.Alias))
+	}
+
+	if account.SourceIdentity != "" && (!sessionNamePattern.MatchString(account.SourceIdentity) || strings.HasPrefix(account.SourceIdentity, "aws:")) {
+		return errors.New(fmt.Sprintf("invalid source-identity [%s] on [%s]: expected 2 to 64 letters, digits or characters among +=,.@-, not starting with aws:", account.SourceIdentity, account.Alias))
+	}
+
+	if account.MFASerial != "" && !mfaSerialPattern.MatchString(account.MFASerial) {
+		return errors.New(fmt.Sprintf("invalid mfa-serial [%s] on [%s]: expected the ARN or serial number of an MFA device", account.MFASerial, account.Alias))
+	}
+
+	if account.Duration != "" {
+		duration, err := time.ParseDuration(account.Duration)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid duration on [%s]: %v", account.Alias, err))
+		}
+		if duration < MinRoleDuration || duration > MaxRoleDuration {
+			return errors.New(fmt.Sprintf("invalid duration [%s] on [%s]: expected between %s and %s", account.Duration, account.Alias, MinRoleDuration, MaxRoleDuration))
+		}
+		if len(account.AssumeRole) > 1 && duration > MaxChainedRoleDuration {
+			return errors.New(fmt.Sprintf("invalid duration [%s] on [%s]: chained roles last at most %s", account.Duration, account.Alias, MaxChainedRoleDuration))
+		}
+	}
+	return nil
+}
+
+func (account *Account) validateCredentialSource() error {
+	source := account.Credentials
+	sources := 0
+	for _, set := range []bool{source.Profile != "", source.BaseProfile != "", source.WebIdentityTokenFile != "", source.Environment} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.New(fmt.Sprintf("invalid credentials on [%s]: only one of profile, base-profile, web-identity-token-file and environment is allowed", account.Alias))
+	}
+
+	if !account.AssumesRole() {
+		if len(account.AssumeRole) > 0 || account.ExternalID != "" || account.SessionName != "" || account.Duration != "" ||
+			account.SourceIdentity != "" || account.MFASerial != "" {
+			return errors.New(fmt.Sprintf("assume-role and its settings not allowed with credentials profile on [%s]: use base-profile to assume a role from a profile", account.Alias))
+		}
+	}
+
+	if source.WebIdentityTokenFile != "" {
+		if account.MFASerial != "" || account.SourceIdentity != "" {
+			return errors.New(fmt.Sprintf("mfa-serial and source-identity not allowed with web-identity-token-file on [%s]", account.Alias))
+		}
+		if account.ExternalID != "" && len(account.AssumeRole) < 2 {
+			return errors.New(fmt.Sprintf("external-id not allowed on a role assumed with web-identity-token-file on [%s]: chain the role of the account", account.Alias))
+		}
+	}
+	return nil
+}
+
+// Whether the account is accessed by assuming its role, or with the credentials of a profile
+func (account *Account) AssumesRole() bool {
+	return account.Credentials.Profile == ""
+}
+
+// Duration of the role sessions, zero for the default of the AWS SDK. The account must be valid
+func (account *Account) RoleDuration() time.Duration {
+	duration, _ := time.ParseDuration(account.Duration)
+	return duration
+}
+
+// organization ARN format: arn:aws:organizations::account-id:organization/o-id
+// organizational unit ARN format: arn:aws:organizations::account-id:ou/o-id/ou-id
+func (organization *Organization) Validate(resourcePrefix string) error {
+	if len(organization.AMIs) < 1 {
+		return errors.New(fmt.Sprintf("organization [%s] does not have any AMIs: required at least one", organization.Alias))
+	}
+
+	if !strings.HasPrefix(organization.ARN, "arn:aws:organizations::") ||
+		!strings.Contains(organization.ARN, fmt.Sprintf(":%s/", resourcePrefix)) {
+		return errors.New(fmt.Sprintf("invalid ARN [%s] for [%s]: expected an [%s] ARN",
+			organization.ARN, organization.Alias, resourcePrefix))
+	}
+
+	for group, selection := range organization.AMIs {
+		if selection.Copy || selection.KMSKeyID != "" || selection.Retention != nil {
+			return errors.New(fmt.Sprintf("copy, kms-key-id and retention not allowed on organization [%s], amis [%s]", organization.Alias, group))
+		}
+	}
+	return nil
+}
+
+func (retention *Retention) Validate() error {
+	if retention.KeepLatest < 0 {
+		return errors.New("keep-latest must not be negative")
+	}
+
+	if retention.UnshareAfter == "" && retention.DeregisterAfter == "" && retention.KeepLatest == 0 {
+		return errors.New("at least one of keep-latest, unshare-after or deregister-after is required")
+	}
+
+	for _, duration := range []string{retention.UnshareAfter, retention.DeregisterAfter} {
+		if _, err := ParseRetentionDuration(duration); err != nil {
+			return err
+		}
+	}
+
+	if retention.DeleteSnapshots && retention.DeregisterAfter == "" {
+		return errors.New("delete-snapshots requires deregister-after")
+	}
+
+	if !strings.Contains(retention.Protection(), "=") {
+		return errors.New(fmt.Sprintf("protect-tag [%s] must have the format Key=Value", retention.ProtectTag))
+	}
+	return nil
+}
+
+func (policy *RetryPolicy) Validate() error {
+	if policy.MaxAttempts < 0 {
+		return errors.New("max-attempts must not be negative")
+	}
+	for _, duration := range []string{policy.BaseDelay, policy.MaxDelay, policy.MaxElapsed} {
+		if duration == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(duration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Override the policy with the fields set in the other policy, e.g. from flags
+func (policy *RetryPolicy) Override(other RetryPolicy) {
+	if other.MaxAttempts > 0 {
+		policy.MaxAttempts = other.MaxAttempts
+	}
+	if other.BaseDelay != "" {
+		policy.BaseDelay = other.BaseDelay
+	}
+	if other.MaxDelay != "" {
+		policy.MaxDelay = other.MaxDelay
+	}
+	if other.MaxElapsed != "" {
+		policy.MaxElapsed = other.MaxElapsed
+	}
+}
+
+func (policy *RetryPolicy) Attempts() int {
+	if policy.MaxAttempts == 0 {
+		return DefaultRetryMaxAttempts
+	}
+	return policy.MaxAttempts
+}
+
+// Base delay, maximum delay and maximum total time, with defaults for the fields not set. The policy must be valid
+func (policy *RetryPolicy) Delays() (time.Duration, time.Duration, time.Duration) {
+	parse := func(duration, defaultDuration string) time.Duration {
+		if duration == "" {
+			duration = defaultDuration
+		}
+		parsed, _ := time.ParseDuration(duration)
+		return parsed
+	}
+	return parse(policy.BaseDelay, DefaultRetryBaseDelay), parse(policy.MaxDelay, DefaultRetryMaxDelay),
+		parse(policy.MaxElapsed, DefaultRetryMaxElapsed)
+}
+
+// Protect tag as a filter matching protected AMIs
+func (retention *Retention) ProtectFilter() Filter {
+	pair := strings.SplitN(retention.Protection(), "=", 2)
+	return Filter{Property: fmt.Sprintf("tag:%s", pair[0]), Value: pair[1]}
+}
+
+func (retention *Retention) Protection() string {
+	if retention.ProtectTag == "" {
+		return DefaultProtectTag
+	}
+	return retention.ProtectTag
+}
+
+// Parse a duration such as 30d or 12h. An empty duration is zero, negative durations are invalid
+func ParseRetentionDuration(duration string) (time.Duration, error) {
+	if duration == "" {
+		return 0, nil
+	}
+	var parsed time.Duration
+	if strings.HasSuffix(duration, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(duration, "d"))
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("invalid duration [%s]", duration))
+		}
+		parsed = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		if parsed, err = time.ParseDuration(duration); err != nil {
+			return 0, err
+		}
+	}
+	if parsed < 0 {
+		return 0, errors.New(fmt.Sprintf("duration [%s] must not be negative", duration))
+	}
+	return parsed, nil
+}
+
+// KMS key to encrypt copies of the AMIs in the given selection with.
+// The key set on the selection takes precedence over the account key
+func (account *Account) CopyKMSKeyID(group string) string {
+	selection := account.AMIs[group]
+	if !selection.Copy {
+		return ""
+	}
+	if selection.KMSKeyID != "" {
+		return selection.KMSKeyID
+	}
+	return account.KMSKeyID
+}
+
+// Regions the given selection is shared in
+func (account *Account) SelectionRegions(group string) []string {
+	if regions := account.AMIs[group].Regions; len(regions) > 0 {
+		return regions
+	}
+	return account.Regions
+}
+
 // role ARN format: arn:aws:iam::account-id:role/role-name
+// Only the role of the account may be given by name, intermediate roles are in other accounts
 func (account *Account) GenerateRoleARN() {
-	if !strings.HasPrefix(account.AssumeRole, "arn:aws:iam::") {
-		account.AssumeRole = fmt.Sprintf("arn:aws:iam::%s:role/%s", account.ID, account.AssumeRole)
+	last := len(account.AssumeRole) - 1
+	if last >= 0 && !strings.HasPrefix(account.AssumeRole[last], "arn:aws:iam::") {
+		account.AssumeRole[last] = fmt.Sprintf("arn:aws:iam::%s:role/%s", account.ID, account.AssumeRole[last])
 	}
 }
 
+func (chain *RoleChain) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var role string
+	if err := unmarshal(&role); err == nil {
+		*chain = RoleChain{role}
+		return nil
+	}
+	var roles []string
+	if err := unmarshal(&roles); err != nil {
+		return err
+	}
+	*chain = roles
+	return nil
+}
+
+// Role of the account, the last role of the chain
+func (chain RoleChain) Role() string {
+	if len(chain) < 1 {
+		return ""
+	}
+	return chain[len(chain)-1]
+}
+
+// Intermediate roles, assumed in order before the role of the account
+func (chain RoleChain) Via() []string {
+	if len(chain) < 2 {
+		return nil
+	}
+	return chain[:len(chain)-1]
+}
+
+// Accounts without an MFA device assume their role with the MFA device of the config, if any
+func (config *Config) InheritMFASerial() {
+	if config.SourceAccount.MFASerial == "" && config.SourceAccount.inheritsMFASerial() {
+		config.SourceAccount.MFASerial = config.MFASerial
+	}
+	for i := range config.TargetAccounts {
+		if config.TargetAccounts[i].MFASerial == "" && config.TargetAccounts[i].inheritsMFASerial() {
+			config.TargetAccounts[i].MFASerial = config.MFASerial
+		}
+	}
+}
+
+// Accounts accessed with a profile or with a web identity do not use MFA
+func (account *Account) inheritsMFASerial() bool {
+	return account.AssumesRole() && account.Credentials.WebIdentityTokenFile == ""
+}
+
 func (config *Config) CreateRoleARNs() {
 	config.SourceAccount.GenerateRoleARN()
 	for i := range config.TargetAccounts {
@@ -144,31 +602,56 @@ func (config *Config) CreateRoleARNs() {
 	return
 }
 
+// Regions where a selection needs the AMIs of the source account: the regions of each selection, or of its target
+// when the selection has none, and the source regions of replicated selections. Targets without selections need no region
 func (config *Config) ScanRegions() []string {
 	// Use internal cache list if populated
 	if len(config.regions) > 0 {
 		return config.regions
 	}
 	uniqueRegionsMap := make(map[string]struct{})
-	for _, account := range config.TargetAccounts {
-		for _, region := range account.Regions {
-			uniqueRegionsMap[region] = struct{}{}
-		}
-		for _, amis := range account.AMIs {
-			for _, region := range amis.Regions {
+	addSelections := func(targetRegions []string, selections map[string]AMISelection) {
+		for _, amis := range selections {
+			regions := amis.Regions
+			if len(regions) < 1 {
+				regions = targetRegions
+			}
+			for _, region := range regions {
 				uniqueRegionsMap[region] = struct{}{}
 			}
+			if amis.SourceRegion != "" {
+				uniqueRegionsMap[amis.SourceRegion] = struct{}{}
+			}
 		}
 	}
+	for _, account := range config.TargetAccounts {
+		addSelections(account.Regions, account.AMIs)
+	}
+	for _, organization := range config.Organizations() {
+		addSelections(organization.Regions, organization.AMIs)
+	}
 
 	var regions []string
 	for region := range uniqueRegionsMap {
 		regions = append(regions, region)
 	}
+	sort.Strings(regions)
 	config.regions = regions
 	return regions
 }
 
+// SHA-256 of the config file, after resolving variables
+func (config *Config) Hash() string {
+	return config.hash
+}
+
+// Both organizations and organizational units
+func (config *Config) Organizations() []Organization {
+	var organizations []Organization
+	organizations = append(organizations, config.TargetOrganizations...)
+	return append(organizations, config.TargetOrganizationalUnits...)
+}
+
 func (filter Filter) String() string {
 	var invertText string
 	if filter.Invert {
@@ -0,0 +1,236 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package common
+
+import (
+	"gopkg.in/yaml.v2"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionDuration(t *testing.T) {
+	cases := []struct {
+		duration string
+		expected time.Duration
+		invalid  bool
+	}{
+		{duration: "", expected: 0},
+		{duration: "30d", expected: 30 * 24 * time.Hour},
+		{duration: "0d", expected: 0},
+		{duration: "12h", expected: 12 * time.Hour},
+		{duration: "1h30m", expected: 90 * time.Minute},
+		{duration: "d", invalid: true},
+		{duration: "1.5d", invalid: true},
+		{duration: "30", invalid: true},
+		{duration: "month", invalid: true},
+		{duration: "-5d", invalid: true},
+		{duration: "-1h", invalid: true},
+	}
+	for _, c := range cases {
+		t.Run(c.duration, func(t *testing.T) {
+			duration, err := ParseRetentionDuration(c.duration)
+			if c.invalid {
+				if err == nil {
+					t.Errorf("expected an error, got %s", duration)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if duration != c.expected {
+				t.Errorf("expected %s, got %s", c.expected, duration)
+			}
+		})
+	}
+}
+
+func TestRetentionValidate(t *testing.T) {
+	cases := []struct {
+		name      string
+		retention Retention
+		invalid   bool
+	}{
+		{name: "keep-latest", retention: Retention{KeepLatest: 2}},
+		{name: "unshare-after", retention: Retention{UnshareAfter: "30d"}},
+		{name: "deregister-after with snapshots", retention: Retention{DeregisterAfter: "90d", DeleteSnapshots: true}},
+		{name: "empty", retention: Retention{}, invalid: true},
+		{name: "negative keep-latest", retention: Retention{KeepLatest: -1}, invalid: true},
+		{name: "negative unshare-after", retention: Retention{UnshareAfter: "-5d"}, invalid: true},
+		{name: "negative deregister-after", retention: Retention{DeregisterAfter: "-12h"}, invalid: true},
+		{name: "delete-snapshots without deregister-after", retention: Retention{KeepLatest: 1, DeleteSnapshots: true}, invalid: true},
+		{name: "protect-tag without value", retention: Retention{KeepLatest: 1, ProtectTag: "Keep"}, invalid: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.retention.Validate()
+			if c.invalid && err == nil {
+				t.Errorf("expected an error")
+			} else if !c.invalid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRoleChainUnmarshalYAML(t *testing.T) {
+	cases := []struct {
+		name     string
+		raw      string
+		expected RoleChain
+		invalid  bool
+	}{
+		{name: "single role", raw: "assume-role: AMIShareRole", expected: RoleChain{"AMIShareRole"}},
+		{name: "chain", raw: "assume-role: [arn:aws:iam::111111111111:role/Hub, AMIShareRole]",
+			expected: RoleChain{"arn:aws:iam::111111111111:role/Hub", "AMIShareRole"}},
+		{name: "map", raw: "assume-role: {role: AMIShareRole}", invalid: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var account Account
+			err := yaml.Unmarshal([]byte(c.raw), &account)
+			if c.invalid {
+				if err == nil {
+					t.Errorf("expected an error, got %v", account.AssumeRole)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(account.AssumeRole, c.expected) {
+				t.Errorf("expected %v, got %v", c.expected, account.AssumeRole)
+			}
+		})
+	}
+}
+
+func TestValidateRoleChain(t *testing.T) {
+	hub := "arn:aws:iam::111111111111:role/Hub"
+	transit := "arn:aws:iam::333333333333:role/Transit"
+	cases := []struct {
+		name    string
+		account Account
+		invalid string
+	}{
+		{name: "single role", account: Account{AssumeRole: RoleChain{"AMIShareRole"}}},
+		{name: "chain", account: Account{AssumeRole: RoleChain{hub, transit, "AMIShareRole"}}},
+		{name: "chained duration", account: Account{AssumeRole: RoleChain{hub, "AMIShareRole"}, Duration: "1h"}},
+		{name: "intermediate role name", account: Account{AssumeRole: RoleChain{"Hub", "AMIShareRole"}}, invalid: "intermediate roles must be role ARNs"},
+		{name: "cycle", account: Account{AssumeRole: RoleChain{hub, transit, hub, "AMIShareRole"}}, invalid: "role assumed twice"},
+		{name: "cycle through the account role", account: Account{AssumeRole: RoleChain{"arn:aws:iam::222222222222:role/AMIShareRole", "AMIShareRole"}}, invalid: "role assumed twice"},
+		{name: "too long", account: Account{AssumeRole: RoleChain{
+			"arn:aws:iam::111111111111:role/A", "arn:aws:iam::111111111111:role/B", "arn:aws:iam::111111111111:role/C",
+			"arn:aws:iam::111111111111:role/D", "arn:aws:iam::111111111111:role/E", "AMIShareRole",
+		}}, invalid: "at most 5 roles"},
+		{name: "chained duration over an hour", account: Account{AssumeRole: RoleChain{hub, "AMIShareRole"}, Duration: "2h"}, invalid: "chained roles last at most"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			account := c.account
+			account.ID = "222222222222"
+			account.Alias = "a"
+			expectError(t, account.ValidateRoleSettings(), c.invalid)
+		})
+	}
+}
+
+// Check that err matches the expected error message part, or that there is no error if none is expected
+func expectError(t *testing.T, err error, expected string) {
+	t.Helper()
+	if expected == "" {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		return
+	}
+	if err == nil {
+		t.Errorf("expected an error containing %q", expected)
+	} else if !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected an error containing %q, got %v", expected, err)
+	}
+}
+
+func TestValidateRoleSettings(t *testing.T) {
+	cases := []struct {
+		name    string
+		account Account
+		invalid string
+	}{
+		{name: "defaults", account: Account{}},
+		{name: "all settings", account: Account{ExternalID: "ami-share:ci/1", SessionName: "ami-share@ci", Duration: "2h",
+			SourceIdentity: "ci-operator", MFASerial: "arn:aws:iam::111111111111:mfa/ci-operator"}},
+		{name: "shortest duration", account: Account{Duration: "15m"}},
+		{name: "longest duration", account: Account{Duration: "12h"}},
+		{name: "duration too short", account: Account{Duration: "14m"}, invalid: "expected between"},
+		{name: "duration too long", account: Account{Duration: "13h"}, invalid: "expected between"},
+		{name: "invalid duration", account: Account{Duration: "1d"}, invalid: "invalid duration"},
+		{name: "external-id too short", account: Account{ExternalID: "x"}, invalid: "invalid external-id"},
+		{name: "external-id too long", account: Account{ExternalID: strings.Repeat("x", 1225)}, invalid: "invalid external-id"},
+		{name: "external-id with space", account: Account{ExternalID: "ami share"}, invalid: "invalid external-id"},
+		{name: "session-name too long", account: Account{SessionName: strings.Repeat("s", 65)}, invalid: "invalid session-name"},
+		{name: "session-name with slash", account: Account{SessionName: "ami/share"}, invalid: "invalid session-name"},
+		{name: "source-identity with aws prefix", account: Account{SourceIdentity: "aws:ci"}, invalid: "invalid source-identity"},
+		{name: "mfa-serial too short", account: Account{MFASerial: "mfa"}, invalid: "invalid mfa-serial"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			account := c.account
+			account.ID = "222222222222"
+			account.Alias = "a"
+			account.AssumeRole = RoleChain{"AMIShareRole"}
+			expectError(t, account.ValidateRoleSettings(), c.invalid)
+		})
+	}
+}
+
+func TestValidateCredentialSource(t *testing.T) {
+	cases := []struct {
+		name    string
+		account Account
+		invalid string
+	}{
+		{name: "default credential chain", account: Account{AssumeRole: RoleChain{"AMIShareRole"}}},
+		{name: "profile", account: Account{Credentials: CredentialSource{Profile: "ci"}}},
+		{name: "base profile", account: Account{AssumeRole: RoleChain{"AMIShareRole"}, Credentials: CredentialSource{BaseProfile: "ci"}}},
+		{name: "environment", account: Account{AssumeRole: RoleChain{"AMIShareRole"}, Credentials: CredentialSource{Environment: true}}},
+		{name: "web identity", account: Account{AssumeRole: RoleChain{"AMIShareRole"}, Credentials: CredentialSource{WebIdentityTokenFile: "/var/run/token"}}},
+		{name: "web identity with chained external-id", account: Account{AssumeRole: RoleChain{"arn:aws:iam::111111111111:role/Hub", "AMIShareRole"},
+			ExternalID: "ami-share", Credentials: CredentialSource{WebIdentityTokenFile: "/var/run/token"}}},
+		{name: "profile and base profile", account: Account{Credentials: CredentialSource{Profile: "ci", BaseProfile: "ci"}}, invalid: "only one of"},
+		{name: "environment and web identity", account: Account{AssumeRole: RoleChain{"AMIShareRole"},
+			Credentials: CredentialSource{Environment: true, WebIdentityTokenFile: "/var/run/token"}}, invalid: "only one of"},
+		{name: "profile with role", account: Account{AssumeRole: RoleChain{"AMIShareRole"}, Credentials: CredentialSource{Profile: "ci"}}, invalid: "not allowed with credentials profile"},
+		{name: "profile with role settings", account: Account{SessionName: "ami-share", Credentials: CredentialSource{Profile: "ci"}}, invalid: "not allowed with credentials profile"},
+		{name: "web identity with mfa", account: Account{AssumeRole: RoleChain{"AMIShareRole"}, MFASerial: "arn:aws:iam::111111111111:mfa/ci",
+			Credentials: CredentialSource{WebIdentityTokenFile: "/var/run/token"}}, invalid: "not allowed with web-identity-token-file"},
+		{name: "web identity with source identity", account: Account{AssumeRole: RoleChain{"AMIShareRole"}, SourceIdentity: "ci",
+			Credentials: CredentialSource{WebIdentityTokenFile: "/var/run/token"}}, invalid: "not allowed with web-identity-token-file"},
+		{name: "web identity with external-id", account: Account{AssumeRole: RoleChain{"AMIShareRole"}, ExternalID: "ami-share",
+			Credentials: CredentialSource{WebIdentityTokenFile: "/var/run/token"}}, invalid: "external-id not allowed"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			account := c.account
+			account.ID = "222222222222"
+			account.Alias = "a"
+			expectError(t, account.ValidateRoleSettings(), c.invalid)
+		})
+	}
+}
@@ -18,6 +18,7 @@
 package common
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/rebuy-de/aws-nuke/pkg/types"
 	"sort"
@@ -27,13 +28,51 @@ import (
 type Image interface {
 	Properties() types.Properties
 	Date() time.Time
+	Region() string
 	String() string
 
 	Match(Filter) bool
-	AddTags(map[string]string, bool) error
-	ShareWithAccount(string, bool) error
-	CopyTags(*session.Session, bool) error
-	MarshalYAML() (interface{}, error)
+	IsSharedWith(string) bool
+	LaunchPermissions(context.Context) ([]string, error)
+	AddTags(context.Context, map[string]string, bool) error
+	RemoveTags(context.Context, []string, bool) error
+	ShareWithAccount(context.Context, string, bool) error
+	ShareSnapshotsWithAccount(context.Context, string) error
+	SnapshotsSharedWithAccount(context.Context, string) (bool, error)
+	ShareWithOrganization(context.Context, string, bool) error
+	ShareWithOrganizationalUnit(context.Context, string, bool) error
+	UnshareWithAccount(context.Context, string, bool) error
+	UnshareSnapshotsWithAccount(context.Context, string) error
+	Deregister(context.Context, bool) error
+	CopyTags(context.Context, *session.Session, bool) error
+	CopyToAccount(context.Context, *session.Session, string, string) (string, error)
+	Replicate(context.Context, *session.Session, string, string) (string, error)
+	CompleteCopy(context.Context, *session.Session, string) error
+	KMSKeys(context.Context) ([]string, error)
+	Describe() ImageDescription
+}
+
+const (
+	// Actions planned for an image and a target
+	ImageActionShare         = "share"
+	ImageActionAlreadyShared = "already-shared"
+)
+
+// Structured description of an image, as written in plans
+type ImageDescription struct {
+	ID           string                `yaml:"id" json:"id"`
+	Name         string                `yaml:"name" json:"name"`
+	CreationDate string                `yaml:"creation-date" json:"creation-date"`
+	Region       string                `yaml:"region" json:"region"`
+	State        string                `yaml:"state" json:"state"`
+	Snapshots    []SnapshotDescription `yaml:"snapshots,omitempty" json:"snapshots,omitempty"`
+	Tags         map[string]string     `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Action       string                `yaml:"action,omitempty" json:"action,omitempty"`
+}
+
+type SnapshotDescription struct {
+	ID        string `yaml:"id" json:"id"`
+	Encrypted bool   `yaml:"encrypted" json:"encrypted"`
 }
 
 // For sorting images
@@ -52,6 +91,16 @@ func (e Images) Less(i, j int) bool {
 
 // Given a list of images apply a set of filters and pick the latest image
 func ApplyFilters(images Images, filters []Filter) Images {
+	result := MatchFilters(images, filters)
+	if len(result) > 0 {
+		// return the latest AMI only
+		return Images{result[len(result)-1]}
+	}
+	return result
+}
+
+// Given a list of images apply a set of filters, sorted from oldest to latest image
+func MatchFilters(images Images, filters []Filter) Images {
 	var result Images
 	for _, image := range images {
 		matches := true
@@ -63,9 +112,15 @@ func ApplyFilters(images Images, filters []Filter) Images {
 		}
 	}
 	sort.Sort(result)
-	if len(result) > 0 {
-		// return the latest AMI only
-		return Images{result[len(result)-1]}
-	}
 	return result
 }
+
+// Find an image by ID
+func FindImage(images Images, id string) Image {
+	for _, image := range images {
+		if image.String() == id {
+			return image
+		}
+	}
+	return nil
+}
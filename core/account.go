@@ -18,6 +18,7 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/service/iam"
@@ -25,6 +26,7 @@ import (
 	"github.com/elastic/aws-ami-share/common"
 	"github.com/elastic/aws-ami-share/utils"
 	log "github.com/sirupsen/logrus"
+	"strings"
 )
 
 const (
@@ -32,34 +34,61 @@ const (
 )
 
 func AccountSessionKey(account *common.Account, region string) utils.SessionKey {
+	return utils.SessionKey{
+		AccountID:      account.ID,
+		AssumeRole:     account.AssumeRole.Role(),
+		Via:            strings.Join(account.AssumeRole.Via(), " "),
+		Region:         region,
+		ExternalID:     account.ExternalID,
+		SessionName:    account.SessionName,
+		Duration:       account.RoleDuration(),
+		SourceIdentity: account.SourceIdentity,
+		MFASerial:      account.MFASerial,
+		Source: utils.CredentialSource{
+			Profile:              account.Credentials.Profile,
+			BaseProfile:          account.Credentials.BaseProfile,
+			WebIdentityTokenFile: account.Credentials.WebIdentityTokenFile,
+			Environment:          account.Credentials.Environment,
+		},
+	}
+}
+
+// Session key of a target account of the plan, with the role settings of the account in the config
+func (shareAMI *AWSShareAMI) targetSessionKey(account *AMISharePlanAccount, region string) utils.SessionKey {
+	config := shareAMI.ShareParams.Config
+	for i := range config.TargetAccounts {
+		if config.TargetAccounts[i].ID == account.ID {
+			return AccountSessionKey(&config.TargetAccounts[i], region)
+		}
+	}
 	return utils.SessionKey{AccountID: account.ID, AssumeRole: account.AssumeRole, Region: region}
 }
 
-func GetAccount(sessionFactory *utils.AWSSessionFactory, configAccount *common.Account) (common.Account, error) {
+func GetAccount(ctx context.Context, sessionFactory *utils.AWSSessionFactory, configAccount *common.Account) (common.Account, error) {
 	logger := log.WithFields(log.Fields{
 		"profile":   configAccount.ID,
 		"operation": "account-info",
 	})
 
 	var account common.Account
-	sess, err := sessionFactory.GetSession(AccountSessionKey(configAccount, DefaultRegion))
+	sess, err := sessionFactory.GetSession(ctx, AccountSessionKey(configAccount, DefaultRegion))
 	if err != nil {
 		return account, err
 	}
 
-	identityOutput, err := sts.New(sess).GetCallerIdentity(nil)
+	identityOutput, err := sts.New(sess).GetCallerIdentityWithContext(ctx, nil)
 	if err != nil {
 		logger.Errorf("failed to get caller identity for account")
 		return account, err
 	}
 	account.ID = *identityOutput.Account
 
-	globalSession, err := sessionFactory.GetSession(AccountSessionKey(configAccount, DefaultRegion))
+	globalSession, err := sessionFactory.GetSession(ctx, AccountSessionKey(configAccount, DefaultRegion))
 	if err != nil {
 		logger.Errorf("failed to create default session in %s", DefaultRegion)
 		return account, err
 	}
-	aliasesOutput, err := iam.New(globalSession).ListAccountAliases(nil)
+	aliasesOutput, err := iam.New(globalSession).ListAccountAliasesWithContext(ctx, nil)
 	if err != nil {
 		logger.Errorf("failed to get account alias")
 		return account, err
@@ -69,8 +98,8 @@ func GetAccount(sessionFactory *utils.AWSSessionFactory, configAccount *common.A
 	return account, nil
 }
 
-func ValidateAccount(sessionFactory *utils.AWSSessionFactory, account *common.Account) error {
-	expectedAccount, err := GetAccount(sessionFactory, account)
+func ValidateAccount(ctx context.Context, sessionFactory *utils.AWSSessionFactory, account *common.Account) error {
+	expectedAccount, err := GetAccount(ctx, sessionFactory, account)
 	if err != nil {
 		return err
 	}
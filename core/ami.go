@@ -18,8 +18,10 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/elastic/aws-ami-share/common"
@@ -29,6 +31,13 @@ import (
 	"time"
 )
 
+const (
+	// Tag holding the ID of the source AMI of a cross-region replica, or of a copy in a target account
+	LineageTag = "ShareSourceAMI"
+	// Polling for a copied image every 15 seconds, waits up to 1 hour
+	CopyWaitMaxAttempts = 240
+)
+
 var (
 	logger = log.WithFields(log.Fields{"context": "aws-amis"})
 )
@@ -43,11 +52,17 @@ type EC2Image struct {
 	tagsStr      string
 	snapshots    []string
 	snapshotTags map[string][]*ec2.Tag
+	// snapshot ID by device name, for matching the snapshots of a copy
+	deviceSnapshots map[string]string
+	// meta tags added by this utility when sharing
+	sharedWith         []string
+	state              string
+	encryptedSnapshots map[string]bool
 }
 
 // List AMIs from the given AWS session
-// the session is attached to an AWS account and region
-func ListAMIs(sess *session.Session) (common.Images, error) {
+// the session is attached to an AWS account and region. Describe calls are retried with the given retry
+func ListAMIs(ctx context.Context, sess *session.Session, retry Retry) (common.Images, error) {
 	var images common.Images
 	svc := ec2.New(sess)
 	params := &ec2.DescribeImagesInput{
@@ -55,22 +70,76 @@ func ListAMIs(sess *session.Session) (common.Images, error) {
 			aws.String("self"),
 		},
 	}
-	resp, err := svc.DescribeImages(params)
+	var resp *ec2.DescribeImagesOutput
+	err := retry(ctx, "describing AMIs", func(ctx context.Context) (err error) {
+		resp, err = svc.DescribeImagesWithContext(ctx, params)
+		return err
+	})
 	if err != nil {
 		return images, err
 	}
 
 	for _, out := range resp.Images {
-		var snapshots []string
-		snapshotTags := make(map[string][]*ec2.Tag)
-		for _, blockDevice := range out.BlockDeviceMappings {
-			if blockDevice == nil || blockDevice.Ebs == nil {
-				logger.Debugf("Skipping block device: %v, because no snapshot to share", blockDevice)
-				continue
-			}
-			snapshotId := aws.StringValue(blockDevice.Ebs.SnapshotId)
-			snapshots = append(snapshots, snapshotId)
-			tagsOutput, err := svc.DescribeTags(&ec2.DescribeTagsInput{
+		image, err := newEC2Image(ctx, svc, out, retry)
+		if err != nil {
+			return images, err
+		}
+		images = append(images, image)
+	}
+
+	return images, nil
+}
+
+// Load AMIs by ID from the given AWS session
+// IDs are given as a filter: unlike ImageIds, it does not fail for deregistered AMIs
+func LoadAMIs(ctx context.Context, sess *session.Session, ids []string, retry Retry) (common.Images, error) {
+	var images common.Images
+	svc := ec2.New(sess)
+	var resp *ec2.DescribeImagesOutput
+	err := retry(ctx, "loading AMIs", func(ctx context.Context) (err error) {
+		resp, err = svc.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+			Filters: []*ec2.Filter{
+				{
+					Name:   aws.String("image-id"),
+					Values: aws.StringSlice(ids),
+				},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return images, err
+	}
+
+	for _, out := range resp.Images {
+		image, err := newEC2Image(ctx, svc, out, retry)
+		if err != nil {
+			return images, err
+		}
+		images = append(images, image)
+	}
+
+	return images, nil
+}
+
+// Describe an image of the given EC2 client, with the tags of its snapshots
+func newEC2Image(ctx context.Context, svc *ec2.EC2, out *ec2.Image, retry Retry) (*EC2Image, error) {
+	var snapshots []string
+	snapshotTags := make(map[string][]*ec2.Tag)
+	deviceSnapshots := make(map[string]string)
+	encryptedSnapshots := make(map[string]bool)
+	for _, blockDevice := range out.BlockDeviceMappings {
+		if blockDevice == nil || blockDevice.Ebs == nil {
+			logger.Debugf("Skipping block device: %v, because no snapshot to share", blockDevice)
+			continue
+		}
+		snapshotId := aws.StringValue(blockDevice.Ebs.SnapshotId)
+		snapshots = append(snapshots, snapshotId)
+		deviceSnapshots[aws.StringValue(blockDevice.DeviceName)] = snapshotId
+		encryptedSnapshots[snapshotId] = aws.BoolValue(blockDevice.Ebs.Encrypted)
+		var tagsOutput *ec2.DescribeTagsOutput
+		err := retry(ctx, fmt.Sprintf("describing tags of snapshot [%s]", snapshotId), func(ctx context.Context) (err error) {
+			tagsOutput, err = svc.DescribeTagsWithContext(ctx, &ec2.DescribeTagsInput{
 				Filters: []*ec2.Filter{
 					{
 						Name: aws.String("resource-id"),
@@ -80,51 +149,56 @@ func ListAMIs(sess *session.Session) (common.Images, error) {
 					},
 				},
 			})
-			if err != nil {
-				return images, err
-			}
-
-			var tags []*ec2.Tag
-			for _, tagDesc := range tagsOutput.Tags {
-				// Filter out meta tags added by this utility
-				if strings.HasPrefix(aws.StringValue(tagDesc.Key), ShareWithPrefix) {
-					continue
-				}
-				tags = append(tags, &ec2.Tag{Key: tagDesc.Key, Value: tagDesc.Value})
-			}
-			snapshotTags[snapshotId] = tags
+			return err
+		})
+		if err != nil {
+			return nil, err
 		}
 
-		var filteredTags []*ec2.Tag
-		for _, tag := range out.Tags {
+		var tags []*ec2.Tag
+		for _, tagDesc := range tagsOutput.Tags {
 			// Filter out meta tags added by this utility
-			if strings.HasPrefix(aws.StringValue(tag.Key), ShareWithPrefix) {
+			if strings.HasPrefix(aws.StringValue(tagDesc.Key), ShareWithPrefix) {
 				continue
 			}
-			filteredTags = append(filteredTags, tag)
-		}
-
-		date, _ := time.Parse(time.RFC3339, *out.CreationDate)
-		images = append(images, &EC2Image{
-			svc:          svc,
-			date:         date,
-			dateStr:      *out.CreationDate,
-			id:           *out.ImageId,
-			name:         *out.Name,
-			tags:         filteredTags,
-			snapshots:    snapshots,
-			snapshotTags: snapshotTags,
-		})
+			tags = append(tags, &ec2.Tag{Key: tagDesc.Key, Value: tagDesc.Value})
+		}
+		snapshotTags[snapshotId] = tags
 	}
 
-	return images, nil
+	var filteredTags []*ec2.Tag
+	var sharedWith []string
+	for _, tag := range out.Tags {
+		// Filter out meta tags added by this utility
+		if strings.HasPrefix(aws.StringValue(tag.Key), ShareWithPrefix) {
+			sharedWith = append(sharedWith, aws.StringValue(tag.Key))
+			continue
+		}
+		filteredTags = append(filteredTags, tag)
+	}
+
+	date, _ := time.Parse(time.RFC3339, *out.CreationDate)
+	return &EC2Image{
+		svc:                svc,
+		date:               date,
+		dateStr:            *out.CreationDate,
+		id:                 *out.ImageId,
+		name:               *out.Name,
+		tags:               filteredTags,
+		snapshots:          snapshots,
+		snapshotTags:       snapshotTags,
+		deviceSnapshots:    deviceSnapshots,
+		sharedWith:         sharedWith,
+		state:              aws.StringValue(out.State),
+		encryptedSnapshots: encryptedSnapshots,
+	}, nil
 }
 
 // Copy tags to target account via AWS session
 // the session is attached to an AWS account and region
-func (e *EC2Image) CopyTags(sess *session.Session, shareSnapshots bool) error {
+func (e *EC2Image) CopyTags(ctx context.Context, sess *session.Session, shareSnapshots bool) error {
 	svc := ec2.New(sess)
-	_, err := svc.CreateTags(&ec2.CreateTagsInput{
+	_, err := svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
 		Resources: []*string{
 			aws.String(e.id),
 		},
@@ -136,7 +210,7 @@ func (e *EC2Image) CopyTags(sess *session.Session, shareSnapshots bool) error {
 
 	if shareSnapshots {
 		for snapshotId, tags := range e.snapshotTags {
-			_, err := svc.CreateTags(&ec2.CreateTagsInput{
+			_, err := svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
 				Resources: []*string{
 					aws.String(snapshotId),
 				},
@@ -151,6 +225,166 @@ func (e *EC2Image) CopyTags(sess *session.Session, shareSnapshots bool) error {
 	return nil
 }
 
+// Start copying the image into the account of the given AWS session, in the same region, and return the ID of the copy.
+// The image and its snapshots must already be shared with that account.
+// If a KMS key is given, the snapshots of the copy are encrypted with it.
+// Retrying with the same client token returns the same copy instead of starting another one
+func (e *EC2Image) CopyToAccount(ctx context.Context, sess *session.Session, kmsKeyId string, clientToken string) (string, error) {
+	return e.startCopy(ctx, ec2.New(sess), kmsKeyId, clientToken)
+}
+
+// Start copying the image into the region of the given AWS session, in the source account, and return the ID of the replica.
+// If a KMS key is given, the snapshots of the copy are encrypted with it.
+// Retrying with the same client token returns the same replica instead of starting another one
+func (e *EC2Image) Replicate(ctx context.Context, sess *session.Session, kmsKeyId string, clientToken string) (string, error) {
+	return e.startCopy(ctx, ec2.New(sess), kmsKeyId, clientToken)
+}
+
+// Find the copies of source AMIs owned by the account of the given AWS session, by their lineage tag.
+// Returns the ID of the latest copy by source AMI ID. Failed copies are ignored
+func ListCopies(ctx context.Context, sess *session.Session, sourceIds []string) (map[string]string, error) {
+	resp, err := ec2.New(sess).DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		Owners: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String(fmt.Sprintf("tag:%s", LineageTag)),
+				Values: aws.StringSlice(sourceIds),
+			},
+			{
+				Name:   aws.String("state"),
+				Values: aws.StringSlice([]string{ec2.ImageStatePending, ec2.ImageStateAvailable}),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	copies := make(map[string]string)
+	created := make(map[string]string)
+	for _, out := range resp.Images {
+		for _, tag := range out.Tags {
+			if aws.StringValue(tag.Key) != LineageTag {
+				continue
+			}
+			sourceId := aws.StringValue(tag.Value)
+			// Creation dates are RFC 3339 timestamps in UTC, sorted as strings
+			if aws.StringValue(out.CreationDate) >= created[sourceId] {
+				copies[sourceId] = aws.StringValue(out.ImageId)
+				created[sourceId] = aws.StringValue(out.CreationDate)
+			}
+		}
+	}
+	return copies, nil
+}
+
+// Tags of a copy of the image, with the lineage tag holding the source AMI it descends from:
+// a copy of a replica descends from the source AMI of the replica
+func (e *EC2Image) copyTags() []*ec2.Tag {
+	lineage := e.id
+	var tags []*ec2.Tag
+	for _, tag := range e.tags {
+		if aws.StringValue(tag.Key) != LineageTag {
+			tags = append(tags, tag)
+		} else if aws.StringValue(tag.Value) != "" {
+			lineage = aws.StringValue(tag.Value)
+		}
+	}
+	return append([]*ec2.Tag{{Key: aws.String(LineageTag), Value: aws.String(lineage)}}, tags...)
+}
+
+func (e *EC2Image) startCopy(ctx context.Context, svc *ec2.EC2, kmsKeyId string, clientToken string) (string, error) {
+	copyInput := &ec2.CopyImageInput{
+		Name:          aws.String(e.name),
+		SourceImageId: aws.String(e.id),
+		SourceRegion:  e.svc.Config.Region,
+		ClientToken:   aws.String(clientToken),
+	}
+	if kmsKeyId != "" {
+		copyInput.Encrypted = aws.Bool(true)
+		copyInput.KmsKeyId = aws.String(kmsKeyId)
+	}
+	copyOutput, err := svc.CopyImageWithContext(ctx, copyInput)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(copyOutput.ImageId), nil
+}
+
+// Complete a copy or replica of the image started in the account and region of the given AWS session:
+// tag it with the tags of the image and the lineage tag, wait for it to become available and tag its snapshots.
+// Every call can be retried
+func (e *EC2Image) CompleteCopy(ctx context.Context, sess *session.Session, id string) error {
+	svc := ec2.New(sess)
+	// Pending copies are tagged at once, so a copy is found by its lineage tag even if waiting for it fails
+	_, err := svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      e.copyTags(),
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Waiting for copy %s of AMI %s to become available", id, e.id)
+	describeInput := &ec2.DescribeImagesInput{ImageIds: []*string{aws.String(id)}}
+	err = svc.WaitUntilImageAvailableWithContext(ctx, describeInput,
+		request.WithWaiterMaxAttempts(CopyWaitMaxAttempts))
+	if err != nil {
+		return err
+	}
+
+	resp, err := svc.DescribeImagesWithContext(ctx, describeInput)
+	if err != nil {
+		return err
+	}
+	for _, out := range resp.Images {
+		for _, blockDevice := range out.BlockDeviceMappings {
+			if blockDevice == nil || blockDevice.Ebs == nil {
+				continue
+			}
+			tags := e.snapshotTags[e.deviceSnapshots[aws.StringValue(blockDevice.DeviceName)]]
+			if len(tags) < 1 {
+				continue
+			}
+			_, err := svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+				Resources: []*string{blockDevice.Ebs.SnapshotId},
+				Tags:      tags,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ARNs of the KMS keys encrypting the snapshots of the image
+func (e *EC2Image) KMSKeys(ctx context.Context) ([]string, error) {
+	if len(e.snapshots) < 1 {
+		return nil, nil
+	}
+	resp, err := e.svc.DescribeSnapshotsWithContext(ctx, &ec2.DescribeSnapshotsInput{
+		SnapshotIds: aws.StringSlice(e.snapshots),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	uniqueKeys := make(map[string]struct{})
+	var keys []string
+	for _, snapshot := range resp.Snapshots {
+		keyId := aws.StringValue(snapshot.KmsKeyId)
+		if !aws.BoolValue(snapshot.Encrypted) || keyId == "" {
+			continue
+		}
+		if _, ok := uniqueKeys[keyId]; !ok {
+			uniqueKeys[keyId] = struct{}{}
+			keys = append(keys, keyId)
+		}
+	}
+	return keys, nil
+}
+
 func (e *EC2Image) Properties() types.Properties {
 	properties := types.NewProperties()
 	for _, tagValue := range e.tags {
@@ -165,6 +399,10 @@ func (e *EC2Image) String() string {
 	return e.id
 }
 
+func (e *EC2Image) Region() string {
+	return aws.StringValue(e.svc.Config.Region)
+}
+
 func (e *EC2Image) Date() time.Time {
 	return e.date
 }
@@ -177,7 +415,54 @@ func (e *EC2Image) Match(filter common.Filter) bool {
 	return resourceValue == filter.Value
 }
 
-func (e *EC2Image) AddTags(tags map[string]string, tagSnapshots bool) error {
+// Whether the image has the meta tag added when sharing with the given account (or organization) alias
+func (e *EC2Image) IsSharedWith(alias string) bool {
+	for _, key := range e.sharedWith {
+		if key == ShareWithTag(alias) {
+			return true
+		}
+	}
+	return false
+}
+
+// Account IDs, organization ARNs and organizational unit ARNs the image is shared with
+func (e *EC2Image) LaunchPermissions(ctx context.Context) ([]string, error) {
+	attribute, err := e.svc.DescribeImageAttributeWithContext(ctx, &ec2.DescribeImageAttributeInput{
+		ImageId:   aws.String(e.id),
+		Attribute: aws.String(ec2.ImageAttributeNameLaunchPermission),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var permissions []string
+	for _, permission := range attribute.LaunchPermissions {
+		for _, principal := range []*string{permission.UserId, permission.OrganizationArn, permission.OrganizationalUnitArn} {
+			if aws.StringValue(principal) != "" {
+				permissions = append(permissions, aws.StringValue(principal))
+			}
+		}
+	}
+	return permissions, nil
+}
+
+func (e *EC2Image) RemoveTags(ctx context.Context, keys []string, tagSnapshots bool) error {
+	var awsTags []*ec2.Tag
+	for _, key := range keys {
+		awsTags = append(awsTags, &ec2.Tag{Key: aws.String(key)})
+	}
+	resources := []*string{aws.String(e.id)}
+	if tagSnapshots {
+		resources = append(resources, aws.StringSlice(e.snapshots)...)
+	}
+	_, err := e.svc.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+		Resources: resources,
+		Tags:      awsTags,
+	})
+	return err
+}
+
+func (e *EC2Image) AddTags(ctx context.Context, tags map[string]string, tagSnapshots bool) error {
 	var awsTags []*ec2.Tag
 	for key, value := range tags {
 		awsTags = append(awsTags, &ec2.Tag{
@@ -185,7 +470,7 @@ func (e *EC2Image) AddTags(tags map[string]string, tagSnapshots bool) error {
 			Value: aws.String(value),
 		})
 	}
-	_, err := e.svc.CreateTags(&ec2.CreateTagsInput{
+	_, err := e.svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
 		Resources: []*string{
 			aws.String(e.id),
 		},
@@ -197,7 +482,7 @@ func (e *EC2Image) AddTags(tags map[string]string, tagSnapshots bool) error {
 
 	if tagSnapshots {
 		for _, snapshotId := range e.snapshots {
-			_, err := e.svc.CreateTags(&ec2.CreateTagsInput{
+			_, err := e.svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
 				Resources: []*string{
 					aws.String(snapshotId),
 				},
@@ -212,9 +497,9 @@ func (e *EC2Image) AddTags(tags map[string]string, tagSnapshots bool) error {
 	return nil
 }
 
-func (e *EC2Image) ShareWithAccount(accountId string, shareSnapshots bool) error {
+func (e *EC2Image) ShareWithAccount(ctx context.Context, accountId string, shareSnapshots bool) error {
 	awsAccountId := aws.String(accountId)
-	_, err := e.svc.ModifyImageAttribute(
+	_, err := e.svc.ModifyImageAttributeWithContext(ctx,
 		&ec2.ModifyImageAttributeInput{
 			ImageId: aws.String(e.id),
 			LaunchPermission: &ec2.LaunchPermissionModifications{
@@ -226,23 +511,152 @@ func (e *EC2Image) ShareWithAccount(accountId string, shareSnapshots bool) error
 	}
 
 	if shareSnapshots {
+		return e.ShareSnapshotsWithAccount(ctx, accountId)
+	}
+	return nil
+}
+
+func (e *EC2Image) ShareSnapshotsWithAccount(ctx context.Context, accountId string) error {
+	for _, snapshotId := range e.snapshots {
+		_, err := e.svc.ModifySnapshotAttributeWithContext(ctx,
+			&ec2.ModifySnapshotAttributeInput{
+				SnapshotId: aws.String(snapshotId),
+				CreateVolumePermission: &ec2.CreateVolumePermissionModifications{
+					Add: []*ec2.CreateVolumePermission{{UserId: aws.String(accountId)}},
+				},
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether every snapshot of the image has a create volume permission for the account
+func (e *EC2Image) SnapshotsSharedWithAccount(ctx context.Context, accountId string) (bool, error) {
+	for _, snapshotId := range e.snapshots {
+		attribute, err := e.svc.DescribeSnapshotAttributeWithContext(ctx, &ec2.DescribeSnapshotAttributeInput{
+			SnapshotId: aws.String(snapshotId),
+			Attribute:  aws.String(ec2.SnapshotAttributeNameCreateVolumePermission),
+		})
+		if err != nil {
+			return false, err
+		}
+		shared := false
+		for _, permission := range attribute.CreateVolumePermissions {
+			if aws.StringValue(permission.UserId) == accountId {
+				shared = true
+			}
+		}
+		if !shared {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (e *EC2Image) UnshareWithAccount(ctx context.Context, accountId string, unshareSnapshots bool) error {
+	_, err := e.svc.ModifyImageAttributeWithContext(ctx,
+		&ec2.ModifyImageAttributeInput{
+			ImageId: aws.String(e.id),
+			LaunchPermission: &ec2.LaunchPermissionModifications{
+				Remove: []*ec2.LaunchPermission{{UserId: aws.String(accountId)}},
+			},
+		})
+	if err != nil {
+		return err
+	}
+
+	if unshareSnapshots {
+		return e.UnshareSnapshotsWithAccount(ctx, accountId)
+	}
+	return nil
+}
+
+// Revoke the create volume permissions of the account, keeping its launch permission
+func (e *EC2Image) UnshareSnapshotsWithAccount(ctx context.Context, accountId string) error {
+	for _, snapshotId := range e.snapshots {
+		_, err := e.svc.ModifySnapshotAttributeWithContext(ctx,
+			&ec2.ModifySnapshotAttributeInput{
+				SnapshotId: aws.String(snapshotId),
+				CreateVolumePermission: &ec2.CreateVolumePermissionModifications{
+					Remove: []*ec2.CreateVolumePermission{{UserId: aws.String(accountId)}},
+				},
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deregister the image, and optionally delete the snapshots it was using
+func (e *EC2Image) Deregister(ctx context.Context, deleteSnapshots bool) error {
+	_, err := e.svc.DeregisterImageWithContext(ctx, &ec2.DeregisterImageInput{ImageId: aws.String(e.id)})
+	if err != nil {
+		return err
+	}
+
+	if deleteSnapshots {
 		for _, snapshotId := range e.snapshots {
-			_, err = e.svc.ModifySnapshotAttribute(
-				&ec2.ModifySnapshotAttributeInput{
-					SnapshotId: aws.String(snapshotId),
-					CreateVolumePermission: &ec2.CreateVolumePermissionModifications{
-						Add: []*ec2.CreateVolumePermission{{UserId: awsAccountId}},
-					},
-				})
+			_, err := e.svc.DeleteSnapshotWithContext(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapshotId)})
 			if err != nil {
 				return err
 			}
 		}
 	}
 
-	return err
+	return nil
+}
+
+func (e *EC2Image) ShareWithOrganization(ctx context.Context, organizationArn string, shareSnapshots bool) error {
+	return e.shareWithOrganizationPermission(ctx, &ec2.LaunchPermission{OrganizationArn: aws.String(organizationArn)}, shareSnapshots)
+}
+
+func (e *EC2Image) ShareWithOrganizationalUnit(ctx context.Context, organizationalUnitArn string, shareSnapshots bool) error {
+	return e.shareWithOrganizationPermission(ctx, &ec2.LaunchPermission{OrganizationalUnitArn: aws.String(organizationalUnitArn)}, shareSnapshots)
 }
 
-func (e *EC2Image) MarshalYAML() (interface{}, error) {
-	return fmt.Sprintf("ID=%s, Name=%s, Date=%s", e.id, e.name, e.dateStr), nil
+// Snapshot create volume permissions can only be granted to account IDs.
+// Accounts in an organization (or OU) the AMI is shared with get access to the
+// snapshots implicitly when launching the AMI, so there is nothing to share for them
+func (e *EC2Image) shareWithOrganizationPermission(ctx context.Context, permission *ec2.LaunchPermission, shareSnapshots bool) error {
+	_, err := e.svc.ModifyImageAttributeWithContext(ctx,
+		&ec2.ModifyImageAttributeInput{
+			ImageId: aws.String(e.id),
+			LaunchPermission: &ec2.LaunchPermissionModifications{
+				Add: []*ec2.LaunchPermission{permission},
+			},
+		})
+	if err != nil {
+		return err
+	}
+
+	if shareSnapshots && len(e.snapshots) > 0 {
+		logger.Debugf("Skipping snapshots %v of %s: access is granted on launch for organization shares",
+			e.snapshots, e.id)
+	}
+
+	return nil
+}
+
+func (e *EC2Image) Describe() common.ImageDescription {
+	description := common.ImageDescription{
+		ID:           e.id,
+		Name:         e.name,
+		CreationDate: e.dateStr,
+		Region:       e.Region(),
+		State:        e.state,
+		Tags:         make(map[string]string),
+	}
+	for _, snapshotId := range e.snapshots {
+		description.Snapshots = append(description.Snapshots, common.SnapshotDescription{
+			ID:        snapshotId,
+			Encrypted: e.encryptedSnapshots[snapshotId],
+		})
+	}
+	for _, tag := range e.tags {
+		description.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return description
 }
@@ -0,0 +1,264 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/aws-ami-share/common"
+	"io"
+	"sort"
+)
+
+const (
+	DiffAdded       = "added"
+	DiffRemoved     = "removed"
+	DiffReplaced    = "replaced"
+	DiffTagsChanged = "tags-changed"
+
+	DiffFormatText = "text"
+	DiffFormatJSON = "json"
+)
+
+// Version of an AMI in a plan. Version is the value of the version tag, when given
+type ImageVersion struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	CreationDate string `json:"creation-date"`
+	Version      string `json:"version,omitempty"`
+}
+
+// Change of a tag between two versions of an AMI. Old is empty for added tags, New for removed tags
+type TagChange struct {
+	Key string `json:"key"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// Change of the AMIs of a target between two plans
+type PlanDiff struct {
+	Target string        `json:"target"`
+	Group  string        `json:"group"`
+	Region string        `json:"region"`
+	Kind   string        `json:"kind"`
+	Old    *ImageVersion `json:"old,omitempty"`
+	New    *ImageVersion `json:"new,omitempty"`
+	Tags   []TagChange   `json:"tags,omitempty"`
+}
+
+func DiffFormats() []string {
+	return []string{DiffFormatText, DiffFormatJSON}
+}
+
+// Compare the AMIs of the targets of two plans. Targets are matched by alias
+func DiffPlans(old, new *PlanDocument, versionTag string) []PlanDiff {
+	oldTargets := planTargets(old)
+	newTargets := planTargets(new)
+
+	var diffs []PlanDiff
+	for _, target := range unionKeys(targetKeys(oldTargets), targetKeys(newTargets)) {
+		oldGroups, newGroups := oldTargets[target], newTargets[target]
+		for _, group := range unionKeys(sortedKeys(oldGroups), sortedKeys(newGroups)) {
+			for _, region := range unionKeys(regionKeys(oldGroups[group]), regionKeys(newGroups[group])) {
+				diffs = append(diffs, diffImages(target, group, region,
+					oldGroups[group][region], newGroups[group][region], versionTag)...)
+			}
+		}
+	}
+	return diffs
+}
+
+// Write the changes as text, or as a JSON list
+func WriteDiff(w io.Writer, diffs []PlanDiff, format string) error {
+	switch format {
+	case DiffFormatJSON:
+		if diffs == nil {
+			diffs = []PlanDiff{}
+		}
+		raw, err := json.MarshalIndent(diffs, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(raw))
+		return err
+	case DiffFormatText:
+		if len(diffs) < 1 {
+			_, err := fmt.Fprintln(w, "No changes.")
+			return err
+		}
+		for _, diff := range diffs {
+			fmt.Fprintf(w, "%s %s %s: %s", diff.Target, diff.Group, diff.Region, diff.Kind)
+			switch diff.Kind {
+			case DiffAdded:
+				fmt.Fprintf(w, " %s", diff.New)
+			case DiffRemoved:
+				fmt.Fprintf(w, " %s", diff.Old)
+			case DiffReplaced:
+				fmt.Fprintf(w, " %s -> %s", diff.Old, diff.New)
+			case DiffTagsChanged:
+				fmt.Fprintf(w, " %s", diff.New)
+			}
+			fmt.Fprintln(w)
+			for _, tag := range diff.Tags {
+				fmt.Fprintf(w, "    tag %s: %s\n", tag.Key, tag)
+			}
+		}
+		return nil
+	}
+	return errors.New(fmt.Sprintf("invalid diff format [%s]: expected one of %v", format, DiffFormats()))
+}
+
+func (version *ImageVersion) String() string {
+	if version.Version != "" {
+		return fmt.Sprintf("%s (%s, version %s)", version.ID, version.Name, version.Version)
+	}
+	return fmt.Sprintf("%s (%s, %s)", version.ID, version.Name, version.CreationDate)
+}
+
+func (change TagChange) String() string {
+	switch {
+	case change.Old == "":
+		return fmt.Sprintf("added %q", change.New)
+	case change.New == "":
+		return fmt.Sprintf("removed %q", change.Old)
+	}
+	return fmt.Sprintf("%q -> %q", change.Old, change.New)
+}
+
+// AMIs of the plan by target alias
+func planTargets(document *PlanDocument) map[string]PlanImagesByGroup {
+	targets := make(map[string]PlanImagesByGroup)
+	for _, account := range document.TargetAccounts {
+		targets[account.Alias] = account.AMIs
+	}
+	for _, organization := range append(document.TargetOrganizations, document.TargetOrganizationalUnits...) {
+		targets[organization.Alias] = organization.AMIs
+	}
+	return targets
+}
+
+// AMIs removed and added in a region are paired by creation date as replacements
+func diffImages(target, group, region string, oldImages, newImages []common.ImageDescription, versionTag string) []PlanDiff {
+	newByID := make(map[string]common.ImageDescription)
+	for _, image := range newImages {
+		newByID[image.ID] = image
+	}
+	oldByID := make(map[string]common.ImageDescription)
+	for _, image := range oldImages {
+		oldByID[image.ID] = image
+	}
+
+	var diffs []PlanDiff
+	var removed, added []common.ImageDescription
+	for _, image := range oldImages {
+		if newImage, ok := newByID[image.ID]; !ok {
+			removed = append(removed, image)
+		} else if tags := diffTags(image.Tags, newImage.Tags); len(tags) > 0 {
+			diffs = append(diffs, PlanDiff{
+				Target: target, Group: group, Region: region, Kind: DiffTagsChanged,
+				Old: imageVersion(image, versionTag), New: imageVersion(newImage, versionTag), Tags: tags,
+			})
+		}
+	}
+	for _, image := range newImages {
+		if _, ok := oldByID[image.ID]; !ok {
+			added = append(added, image)
+		}
+	}
+	sortByCreationDate(removed)
+	sortByCreationDate(added)
+
+	for len(removed) > 0 && len(added) > 0 {
+		diffs = append(diffs, PlanDiff{
+			Target: target, Group: group, Region: region, Kind: DiffReplaced,
+			Old: imageVersion(removed[0], versionTag), New: imageVersion(added[0], versionTag),
+			Tags: diffTags(removed[0].Tags, added[0].Tags),
+		})
+		removed, added = removed[1:], added[1:]
+	}
+	for _, image := range removed {
+		diffs = append(diffs, PlanDiff{Target: target, Group: group, Region: region, Kind: DiffRemoved, Old: imageVersion(image, versionTag)})
+	}
+	for _, image := range added {
+		diffs = append(diffs, PlanDiff{Target: target, Group: group, Region: region, Kind: DiffAdded, New: imageVersion(image, versionTag)})
+	}
+	return diffs
+}
+
+func imageVersion(image common.ImageDescription, versionTag string) *ImageVersion {
+	version := &ImageVersion{ID: image.ID, Name: image.Name, CreationDate: image.CreationDate}
+	if versionTag != "" {
+		version.Version = image.Tags[versionTag]
+	}
+	return version
+}
+
+func diffTags(oldTags, newTags map[string]string) []TagChange {
+	var changes []TagChange
+	for _, key := range unionKeys(tagKeys(oldTags), tagKeys(newTags)) {
+		if oldTags[key] != newTags[key] {
+			changes = append(changes, TagChange{Key: key, Old: oldTags[key], New: newTags[key]})
+		}
+	}
+	return changes
+}
+
+func sortByCreationDate(images []common.ImageDescription) {
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].CreationDate < images[j].CreationDate
+	})
+}
+
+func targetKeys(targets map[string]PlanImagesByGroup) []string {
+	var keys []string
+	for key := range targets {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func regionKeys(descriptionsByRegion map[string][]common.ImageDescription) []string {
+	var keys []string
+	for key := range descriptionsByRegion {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func tagKeys(tags map[string]string) []string {
+	var keys []string
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Sorted keys present in any of the lists
+func unionKeys(left, right []string) []string {
+	set := make(map[string]bool)
+	for _, key := range append(left, right...) {
+		set[key] = true
+	}
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
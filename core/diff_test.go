@@ -0,0 +1,117 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"github.com/elastic/aws-ami-share/common"
+	"reflect"
+	"testing"
+)
+
+func diffDocument(alias string, images ...common.ImageDescription) *PlanDocument {
+	return &PlanDocument{TargetAccounts: []PlanAccountDocument{{
+		Alias: alias,
+		AMIs:  PlanImagesByGroup{"webapp": {"us-east-1": images}},
+	}}}
+}
+
+func describedImage(id, date, version string) common.ImageDescription {
+	return common.ImageDescription{
+		ID:           id,
+		Name:         "WebApp-" + date,
+		CreationDate: date,
+		Tags:         map[string]string{"Version": version},
+	}
+}
+
+func TestDiffPlans(t *testing.T) {
+	old1 := describedImage("ami-1", "2020-02-01", "1.0")
+	old2 := describedImage("ami-2", "2020-02-02", "1.1")
+	new3 := describedImage("ami-3", "2020-02-03", "1.2")
+	new4 := describedImage("ami-4", "2020-02-04", "1.3")
+	retagged := describedImage("ami-2", "2020-02-02", "1.1-patched")
+
+	cases := []struct {
+		name     string
+		old, new *PlanDocument
+		expected []PlanDiff
+	}{
+		{
+			name: "no changes",
+			old:  diffDocument("integration-account", old1),
+			new:  diffDocument("integration-account", old1),
+		},
+		{
+			name: "added",
+			old:  diffDocument("integration-account", old1),
+			new:  diffDocument("integration-account", old1, new3),
+			expected: []PlanDiff{{Target: "integration-account", Group: "webapp", Region: "us-east-1", Kind: DiffAdded,
+				New: &ImageVersion{ID: "ami-3", Name: "WebApp-2020-02-03", CreationDate: "2020-02-03", Version: "1.2"}}},
+		},
+		{
+			name: "removed",
+			old:  diffDocument("integration-account", old1, old2),
+			new:  diffDocument("integration-account", old2),
+			expected: []PlanDiff{{Target: "integration-account", Group: "webapp", Region: "us-east-1", Kind: DiffRemoved,
+				Old: &ImageVersion{ID: "ami-1", Name: "WebApp-2020-02-01", CreationDate: "2020-02-01", Version: "1.0"}}},
+		},
+		{
+			name: "replaced by creation date",
+			old:  diffDocument("integration-account", old2, old1),
+			new:  diffDocument("integration-account", new4, new3),
+			expected: []PlanDiff{
+				{Target: "integration-account", Group: "webapp", Region: "us-east-1", Kind: DiffReplaced,
+					Old:  &ImageVersion{ID: "ami-1", Name: "WebApp-2020-02-01", CreationDate: "2020-02-01", Version: "1.0"},
+					New:  &ImageVersion{ID: "ami-3", Name: "WebApp-2020-02-03", CreationDate: "2020-02-03", Version: "1.2"},
+					Tags: []TagChange{{Key: "Version", Old: "1.0", New: "1.2"}}},
+				{Target: "integration-account", Group: "webapp", Region: "us-east-1", Kind: DiffReplaced,
+					Old:  &ImageVersion{ID: "ami-2", Name: "WebApp-2020-02-02", CreationDate: "2020-02-02", Version: "1.1"},
+					New:  &ImageVersion{ID: "ami-4", Name: "WebApp-2020-02-04", CreationDate: "2020-02-04", Version: "1.3"},
+					Tags: []TagChange{{Key: "Version", Old: "1.1", New: "1.3"}}},
+			},
+		},
+		{
+			name: "tags changed",
+			old:  diffDocument("integration-account", old2),
+			new:  diffDocument("integration-account", retagged),
+			expected: []PlanDiff{{Target: "integration-account", Group: "webapp", Region: "us-east-1", Kind: DiffTagsChanged,
+				Old:  &ImageVersion{ID: "ami-2", Name: "WebApp-2020-02-02", CreationDate: "2020-02-02", Version: "1.1"},
+				New:  &ImageVersion{ID: "ami-2", Name: "WebApp-2020-02-02", CreationDate: "2020-02-02", Version: "1.1-patched"},
+				Tags: []TagChange{{Key: "Version", Old: "1.1", New: "1.1-patched"}}}},
+		},
+		{
+			name: "target matched by alias",
+			old:  diffDocument("integration-account", old1),
+			new:  diffDocument("staging-account", old1),
+			expected: []PlanDiff{
+				{Target: "integration-account", Group: "webapp", Region: "us-east-1", Kind: DiffRemoved,
+					Old: &ImageVersion{ID: "ami-1", Name: "WebApp-2020-02-01", CreationDate: "2020-02-01", Version: "1.0"}},
+				{Target: "staging-account", Group: "webapp", Region: "us-east-1", Kind: DiffAdded,
+					New: &ImageVersion{ID: "ami-1", Name: "WebApp-2020-02-01", CreationDate: "2020-02-01", Version: "1.0"}},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			diffs := DiffPlans(c.old, c.new, "Version")
+			if !reflect.DeepEqual(diffs, c.expected) {
+				t.Errorf("diffs %+v, expected %+v", diffs, c.expected)
+			}
+		})
+	}
+}
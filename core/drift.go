@@ -0,0 +1,167 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/elastic/aws-ami-share/common"
+)
+
+const (
+	// Kinds of drift between a plan and the current state of its AMIs
+	DriftMissing           = "missing"
+	DriftStateChanged      = "state-changed"
+	DriftAlreadyShared     = "already-shared"
+	DriftPermissionRemoved = "permission-removed"
+)
+
+// Difference between an AMI of a plan and its current state
+type Drift struct {
+	Target string
+	Group  string
+	Region string
+	ID     string
+	Kind   string
+	Detail string
+}
+
+// Re-check the AMIs the plan acts on and their launch permissions for the targets of the plan.
+// Images are the current AMIs by ID: AMIs of the plan missing from it were deregistered
+func (shareAMI *AWSShareAMI) DetectDrift(ctx context.Context, document *PlanDocument, images map[string]common.Image) ([]Drift, error) {
+	var drifts []Drift
+	acted := document.actedImages()
+	for region, descriptions := range document.SourceAccount.AMIs[All] {
+		for _, description := range descriptions {
+			// Other AMIs of the source account may change without making the plan stale
+			if _, ok := acted[description.ID]; !ok {
+				continue
+			}
+			if drift, ok := imageDrift(document.SourceAccount.Alias, All, region, description, images); ok {
+				drifts = append(drifts, drift)
+			}
+		}
+	}
+
+	for _, account := range document.TargetAccounts {
+		targetDrifts, err := targetDrift(ctx, account.Alias, account.ID, account.AMIs, images, shareAMI.retryCall)
+		if err != nil {
+			return drifts, err
+		}
+		drifts = append(drifts, targetDrifts...)
+	}
+
+	for _, organization := range append(document.TargetOrganizations, document.TargetOrganizationalUnits...) {
+		targetDrifts, err := targetDrift(ctx, organization.Alias, organization.ARN, organization.AMIs, images, shareAMI.retryCall)
+		if err != nil {
+			return drifts, err
+		}
+		drifts = append(drifts, targetDrifts...)
+	}
+	return drifts, nil
+}
+
+// IDs of the source AMIs shared, copied, replicated, unshared or deregistered by the plan
+func (document *PlanDocument) actedImages() map[string]struct{} {
+	ids := make(map[string]struct{})
+	add := func(described PlanImagesByGroup) {
+		for _, descriptionsByRegion := range described {
+			for _, descriptions := range descriptionsByRegion {
+				for _, description := range descriptions {
+					ids[description.ID] = struct{}{}
+				}
+			}
+		}
+	}
+	for _, account := range document.TargetAccounts {
+		add(account.AMIs)
+		for _, amiCopy := range account.Copies {
+			ids[amiCopy.SourceID] = struct{}{}
+		}
+		for _, action := range account.RetentionActions {
+			ids[action.ID] = struct{}{}
+		}
+	}
+	for _, organization := range append(document.TargetOrganizations, document.TargetOrganizationalUnits...) {
+		add(organization.AMIs)
+	}
+	for _, replication := range document.Replications {
+		ids[replication.SourceID] = struct{}{}
+	}
+	for _, action := range document.SourceAccount.RetentionActions {
+		ids[action.ID] = struct{}{}
+	}
+	return ids
+}
+
+// Planned shares must not be applied yet, and AMIs already shared must still be shared
+func targetDrift(ctx context.Context, alias, principal string, described PlanImagesByGroup, images map[string]common.Image, retry Retry) ([]Drift, error) {
+	var drifts []Drift
+	for group, descriptionsByRegion := range described {
+		for region, descriptions := range descriptionsByRegion {
+			for _, description := range descriptions {
+				// Missing AMIs and state changes are reported for the source account
+				image, ok := images[description.ID]
+				if !ok {
+					continue
+				}
+				var permissions []string
+				err := retry(ctx, fmt.Sprintf("describing launch permissions of AMI [%s]", description.ID), func(ctx context.Context) (err error) {
+					permissions, err = image.LaunchPermissions(ctx)
+					return err
+				})
+				if err != nil {
+					return drifts, err
+				}
+				shared := false
+				for _, permission := range permissions {
+					shared = shared || permission == principal
+				}
+
+				drift := Drift{Target: alias, Group: group, Region: region, ID: description.ID}
+				if shared && description.Action == common.ImageActionShare {
+					drift.Kind = DriftAlreadyShared
+					drift.Detail = "launch permission was added since the plan was written"
+					drifts = append(drifts, drift)
+				} else if !shared && description.Action == common.ImageActionAlreadyShared {
+					drift.Kind = DriftPermissionRemoved
+					drift.Detail = "launch permission was removed since the plan was written"
+					drifts = append(drifts, drift)
+				}
+			}
+		}
+	}
+	return drifts, nil
+}
+
+func imageDrift(alias, group, region string, description common.ImageDescription, images map[string]common.Image) (Drift, bool) {
+	drift := Drift{Target: alias, Group: group, Region: region, ID: description.ID}
+	image, ok := images[description.ID]
+	if !ok {
+		drift.Kind = DriftMissing
+		drift.Detail = "AMI was deregistered"
+		return drift, true
+	}
+
+	if state := image.Describe().State; state != description.State {
+		drift.Kind = DriftStateChanged
+		drift.Detail = description.State + " => " + state
+		return drift, true
+	}
+	return drift, false
+}
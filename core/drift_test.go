@@ -0,0 +1,110 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"context"
+	"github.com/elastic/aws-ami-share/common"
+	"reflect"
+	"testing"
+)
+
+func TestDetectDrift(t *testing.T) {
+	described := func(id, state, action string) common.ImageDescription {
+		return common.ImageDescription{ID: id, Region: "us-east-1", State: state, Action: action}
+	}
+	document := func(target ...common.ImageDescription) *PlanDocument {
+		return &PlanDocument{
+			SourceAccount: PlanAccountDocument{Alias: "source", AMIs: PlanImagesByGroup{All: {"us-east-1": {
+				described("ami-shared", "available", ""),
+				described("ami-share", "available", ""),
+				described("ami-unrelated", "available", ""),
+			}}}},
+			TargetAccounts: []PlanAccountDocument{{
+				ID:    "222222222222",
+				Alias: "a",
+				AMIs:  PlanImagesByGroup{"web": {"us-east-1": target}},
+			}},
+		}
+	}
+	image := func(id, state string, permissions ...string) common.Image {
+		return &fakeImage{id: id, region: "us-east-1", state: state, launchPermissions: permissions}
+	}
+
+	cases := []struct {
+		name     string
+		document *PlanDocument
+		images   []common.Image
+		expected []string
+	}{
+		{
+			name:     "no drift",
+			document: document(described("ami-share", "available", common.ImageActionShare), described("ami-shared", "available", common.ImageActionAlreadyShared)),
+			images:   []common.Image{image("ami-share", "available"), image("ami-shared", "available", "222222222222"), image("ami-unrelated", "available")},
+		},
+		{
+			name:     "unrelated AMI deregistered",
+			document: document(described("ami-share", "available", common.ImageActionShare)),
+			images:   []common.Image{image("ami-share", "available")},
+		},
+		{
+			name:     "planned AMI deregistered",
+			document: document(described("ami-share", "available", common.ImageActionShare)),
+			images:   []common.Image{image("ami-unrelated", "available")},
+			expected: []string{DriftMissing},
+		},
+		{
+			name:     "state changed",
+			document: document(described("ami-share", "available", common.ImageActionShare)),
+			images:   []common.Image{image("ami-share", "deregistered")},
+			expected: []string{DriftStateChanged},
+		},
+		{
+			name:     "shared in the meantime",
+			document: document(described("ami-share", "available", common.ImageActionShare)),
+			images:   []common.Image{image("ami-share", "available", "222222222222")},
+			expected: []string{DriftAlreadyShared},
+		},
+		{
+			name:     "permission removed",
+			document: document(described("ami-shared", "available", common.ImageActionAlreadyShared)),
+			images:   []common.Image{image("ami-shared", "available", "333333333333")},
+			expected: []string{DriftPermissionRemoved},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			images := make(map[string]common.Image)
+			for _, image := range c.images {
+				images[image.String()] = image
+			}
+			shareAMI := AWSShareAMI{}
+			drifts, err := shareAMI.DetectDrift(context.Background(), c.document, images)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kinds []string
+			for _, drift := range drifts {
+				kinds = append(kinds, drift.Kind)
+			}
+			if !reflect.DeepEqual(kinds, c.expected) {
+				t.Errorf("expected drifts %v, got %v", c.expected, kinds)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"fmt"
+)
+
+// Error of the validation of the flags, the config, the accounts or a plan, before any change is made
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+// Error of an apply which ran to the end, but failed some of its actions
+type PartialApplyError struct {
+	Failures int
+}
+
+func (e *PartialApplyError) Error() string {
+	return fmt.Sprintf("%d actions failed while applying the plan", e.Failures)
+}
+
+// Error of an apply interrupted by a signal, which finished its running steps and skipped the others
+type InterruptedError struct {
+	Failures int
+	Skipped  int
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("apply interrupted: %d actions failed and %d steps were skipped", e.Failures, e.Skipped)
+}
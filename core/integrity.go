@@ -0,0 +1,172 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	ChecksumPrefix = "sha256:"
+)
+
+// Checksum of the plan content, and its ed25519 signature when the plan is signed
+type PlanIntegrity struct {
+	Checksum  string `yaml:"checksum" json:"checksum"`
+	Signature string `yaml:"signature,omitempty" json:"signature,omitempty"`
+}
+
+// Checksum of the plan without its integrity block. The content is encoded as JSON
+// so the checksum does not depend on the format of the plan file
+func (document *PlanDocument) ContentChecksum() (string, error) {
+	content := *document
+	content.Integrity = nil
+
+	// Round trip through YAML first, so that empty and missing lists or maps have the same checksum
+	raw, err := yaml.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	var normalized PlanDocument
+	if err := yaml.Unmarshal(raw, &normalized); err != nil {
+		return "", err
+	}
+	raw, err = json.Marshal(normalized)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%x", ChecksumPrefix, sha256.Sum256(raw)), nil
+}
+
+// Add the integrity block to the plan, signing the checksum if a private key file is given
+func (document *PlanDocument) Seal(privateKeyFile string) error {
+	checksum, err := document.ContentChecksum()
+	if err != nil {
+		return err
+	}
+	integrity := &PlanIntegrity{Checksum: checksum}
+
+	if privateKeyFile != "" {
+		privateKey, err := loadPrivateKey(privateKeyFile)
+		if err != nil {
+			return err
+		}
+		integrity.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(checksum)))
+	}
+	document.Integrity = integrity
+	return nil
+}
+
+// Check the checksum of the plan, and its signature if a public key file is given.
+// Unsigned plans are rejected when a signature is required
+func (document *PlanDocument) Verify(publicKeyFile string, requireSigned bool) error {
+	if document.Integrity == nil || document.Integrity.Checksum == "" {
+		return errors.New("plan has no checksum")
+	}
+
+	checksum, err := document.ContentChecksum()
+	if err != nil {
+		return err
+	}
+	if checksum != document.Integrity.Checksum {
+		return errors.New("plan checksum does not match its content: plan was modified after it was written")
+	}
+
+	if document.Integrity.Signature == "" {
+		if requireSigned {
+			return errors.New("plan is not signed")
+		}
+		return nil
+	}
+
+	if publicKeyFile == "" {
+		if requireSigned {
+			return errors.New("a public key is required to verify the plan signature")
+		}
+		return nil
+	}
+
+	publicKey, err := loadPublicKey(publicKeyFile)
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(document.Integrity.Signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(checksum), signature) {
+		return errors.New("plan signature is not valid for the given public key")
+	}
+	return nil
+}
+
+// PEM encoded PKCS #8 private key, e.g. generated by: openssl genpkey -algorithm ed25519
+func loadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s is not an ed25519 private key", path))
+	}
+	return privateKey, nil
+}
+
+// PEM encoded PKIX public key, e.g. generated by: openssl pkey -in private.pem -pubout
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s is not an ed25519 public key", path))
+	}
+	return publicKey, nil
+}
+
+func readPEM(path, blockType string) (*pem.Block, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil || !strings.HasSuffix(block.Type, blockType) {
+		return nil, errors.New(fmt.Sprintf("%s does not contain a PEM encoded %s", path, blockType))
+	}
+	return block, nil
+}
@@ -0,0 +1,141 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/elastic/aws-ami-share/common"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func integrityPlan() *AMISharePlan {
+	image := &fakeImage{
+		id:     "ami-20200222",
+		region: "us-east-1",
+		date:   time.Date(2020, 2, 22, 0, 0, 0, 0, time.UTC),
+		tags:   map[string]string{"Name": "WebApp-2020-02-22"},
+	}
+	images := ImagesByGroup{"webapp": {"us-east-1": common.Images{image}}}
+	return &AMISharePlan{
+		ConfigHash:    "sha256:0123",
+		SourceAccount: AMISharePlanAccount{ID: "111111111111", Alias: "source-account", AMIs: images},
+		TargetAccounts: []AMISharePlanAccount{{
+			ID:     "222222222222",
+			Alias:  "integration-account",
+			AMIs:   images,
+			Shared: map[string]bool{},
+		}},
+	}
+}
+
+// Write an ed25519 key pair as PEM files, returns the private and public key files
+func writeKeyPair(t *testing.T, dir string) (string, string) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateFile, publicFile := filepath.Join(dir, "private.pem"), filepath.Join(dir, "public.pem")
+	if err := ioutil.WriteFile(privateFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return privateFile, publicFile
+}
+
+func TestPlanIntegrityRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	privateFile, publicFile := writeKeyPair(t, dir)
+
+	cases := []struct {
+		name   string
+		format string
+		signed bool
+	}{
+		{"yaml", PlanFormatYAML, false},
+		{"json", PlanFormatJSON, false},
+		{"signed yaml", PlanFormatYAML, true},
+		{"signed json", PlanFormatJSON, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params := &common.ShareParams{
+				PlanFile:   filepath.Join(dir, strings.Replace(c.name, " ", "-", -1)+"."+c.format),
+				PlanFormat: c.format,
+			}
+			if c.signed {
+				params.PlanSigningKey = privateFile
+			}
+			shareAMI := AWSShareAMI{ShareParams: params, logger: log.WithField("context", "test")}
+			if err := shareAMI.WritePlan(integrityPlan()); err != nil {
+				t.Fatal(err)
+			}
+
+			document, format, err := ReadPlanDocument(params.PlanFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != c.format {
+				t.Errorf("read format %s, expected %s", format, c.format)
+			}
+			if err := document.Verify(publicFile, c.signed); err != nil {
+				t.Errorf("verify: %v", err)
+			}
+			if !c.signed {
+				if err := document.Verify("", true); err == nil {
+					t.Errorf("unsigned plan verified with a signature required")
+				}
+			}
+
+			document.TargetAccounts[0].AMIs["webapp"]["us-east-1"][0].Action = common.ImageActionAlreadyShared
+			if err := document.Verify(publicFile, false); err == nil {
+				t.Errorf("modified plan verified")
+			}
+		})
+	}
+}
+
+func TestPlanIntegrityWrongKey(t *testing.T) {
+	privateFile, _ := writeKeyPair(t, t.TempDir())
+	_, otherPublicFile := writeKeyPair(t, t.TempDir())
+
+	document := integrityPlan().Document()
+	if err := document.Seal(privateFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := document.Verify(otherPublicFile, true); err == nil {
+		t.Errorf("plan verified with another public key")
+	}
+}
@@ -0,0 +1,60 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Error of a step stopped by an interrupt, counted as skipped instead of failed
+var errStepInterrupted = errors.New("step interrupted")
+
+// Context of an in-flight step of the apply. It is not canceled with the apply, so an interrupted apply
+// finishes its running steps and never leaves an AMI shared without its snapshots
+type stepContext struct {
+	context.Context
+}
+
+func (stepContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (stepContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (stepContext) Err() error {
+	return nil
+}
+
+// Whether the apply was interrupted. Steps are no longer started once interrupted, and are counted as skipped
+func (shareAMI *AWSShareAMI) interrupted(ctx context.Context) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+
+	shareAMI.mutex.Lock()
+	defer shareAMI.mutex.Unlock()
+	if shareAMI.report.Skipped == 0 {
+		shareAMI.logger.Warnf("Apply interrupted: finishing the running steps and skipping the remaining steps")
+	}
+	shareAMI.report.Skipped++
+	return true
+}
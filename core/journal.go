@@ -0,0 +1,197 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Step of sharing the snapshots of an AMI, journaled apart from sharing the AMI
+	StepShareSnapshots = "share-snapshots"
+	// Steps of starting a copy or replica, journaled with its ID before waiting for it
+	StepStartCopy      = "start-copy"
+	StepStartReplicate = "start-replicate"
+
+	JournalSuffix = ".journal"
+)
+
+// Completed step of an apply. ID is the result of the step, e.g. the ID of a copy
+type JournalEntry struct {
+	Step     string    `json:"step"`
+	TargetID string    `json:"target-id"`
+	Region   string    `json:"region"`
+	AMI      string    `json:"ami"`
+	ID       string    `json:"id,omitempty"`
+	Time     time.Time `json:"time"`
+	// the step was rolled back, it has to run again
+	Undone bool `json:"undone,omitempty"`
+}
+
+// Steps are keyed by their target, region and source AMI, which do not change when planning again with the same inputs
+func (entry JournalEntry) Key() string {
+	return strings.Join([]string{entry.Step, entry.TargetID, entry.Region, entry.AMI}, "/")
+}
+
+// Journal of the completed steps of an apply, written as one JSON entry per line
+type Journal struct {
+	file *os.File
+	// guarded by mutex
+	completed map[string]JournalEntry
+	mutex     sync.Mutex
+}
+
+// Open the journal at path. When resuming, the steps of the journal are loaded and new steps are appended,
+// otherwise the journal is truncated
+func OpenJournal(path string, resume bool) (*Journal, error) {
+	journal := &Journal{completed: make(map[string]JournalEntry)}
+	var entries []JournalEntry
+	if resume {
+		var err error
+		if entries, err = readJournal(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// Loaded entries are written again, without the last entry if the previous run died while writing it
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	journal.file = file
+	for _, entry := range entries {
+		if err := journal.write(entry); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return journal, nil
+}
+
+func readJournal(path string) ([]JournalEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []JournalEntry
+	var invalid error
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		if invalid != nil {
+			return nil, invalid
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Only the last entry may be cut
+			invalid = errors.New(fmt.Sprintf("invalid journal entry at %s:%d: %v", path, line, err))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Run a step of the apply, unless the journal records it as completed or the apply is interrupted.
+// Returns whether the step is completed
+func (shareAMI *AWSShareAMI) runStep(ctx context.Context, action ActionError, step string, run func(context.Context) error) bool {
+	entry := JournalEntry{Step: step, TargetID: action.TargetID, Region: action.Region, AMI: action.AMI}
+	if shareAMI.journal != nil {
+		if _, ok := shareAMI.journal.Completed(entry); ok {
+			shareAMI.logger.Debugf("Skipping completed step %s of AMI [%s] for [%s] in region [%s]", step, action.AMI, action.TargetID, action.Region)
+			return true
+		}
+	}
+	if shareAMI.interrupted(ctx) {
+		return false
+	}
+
+	retries, err := shareAMI.withRetries(ctx, action, step, run)
+	if err != nil {
+		action.Retries = retries
+		shareAMI.actionFailed(action, step, err)
+		return false
+	}
+	shareAMI.recordStep(entry)
+	return true
+}
+
+// Record a completed step in the journal, if any. A step missing in the journal is only run again when resuming
+func (shareAMI *AWSShareAMI) recordStep(entry JournalEntry) {
+	if shareAMI.journal == nil {
+		return
+	}
+	if err := shareAMI.journal.Record(entry); err != nil {
+		shareAMI.logger.Warnf("Failed to record step %s of AMI [%s] in journal. Error: %s", entry.Step, entry.AMI, err)
+	}
+}
+
+// Number of completed steps loaded from the journal or recorded since
+func (journal *Journal) Len() int {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	return len(journal.completed)
+}
+
+// The entry of the step, if it was completed
+func (journal *Journal) Completed(step JournalEntry) (JournalEntry, bool) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	entry, ok := journal.completed[step.Key()]
+	return entry, ok
+}
+
+// Record a completed step
+func (journal *Journal) Record(entry JournalEntry) error {
+	entry.Time = time.Now()
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	return journal.write(entry)
+}
+
+func (journal *Journal) write(entry JournalEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := journal.file.Write(append(raw, '\n')); err != nil {
+		return err
+	}
+	if entry.Undone {
+		delete(journal.completed, entry.Key())
+	} else {
+		journal.completed[entry.Key()] = entry
+	}
+	return nil
+}
+
+func (journal *Journal) Close() error {
+	return journal.file.Close()
+}
@@ -0,0 +1,99 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadJournal(t *testing.T) {
+	entry := `{"step":"share","target-id":"222222222222","region":"us-east-1","ami":"ami-1","time":"2020-02-22T00:00:00Z"}`
+	copied := `{"step":"copy","target-id":"222222222222","region":"us-east-1","ami":"ami-1","id":"ami-2","time":"2020-02-22T00:00:00Z"}`
+
+	cases := []struct {
+		name    string
+		content string
+		keys    []string
+		invalid bool
+	}{
+		{"empty", "", nil, false},
+		{"entries", entry + "\n" + copied + "\n", []string{"share/222222222222/us-east-1/ami-1", "copy/222222222222/us-east-1/ami-1"}, false},
+		{"blank lines", "\n" + entry + "\n\n", []string{"share/222222222222/us-east-1/ami-1"}, false},
+		{"cut last entry", entry + "\n" + copied[:20], []string{"share/222222222222/us-east-1/ami-1"}, false},
+		{"invalid entry", copied[:20] + "\n" + entry + "\n", nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "plan.yaml"+JournalSuffix)
+			if err := ioutil.WriteFile(path, []byte(c.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := readJournal(path)
+			if c.invalid {
+				if err == nil {
+					t.Errorf("invalid journal read")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(c.keys) {
+				t.Fatalf("read %d entries, expected %d", len(entries), len(c.keys))
+			}
+			for i, key := range c.keys {
+				if entries[i].Key() != key {
+					t.Errorf("entry %d has key %s, expected %s", i, entries[i].Key(), key)
+				}
+			}
+		})
+	}
+}
+
+func TestJournalResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.yaml"+JournalSuffix)
+	step := JournalEntry{Step: "copy", TargetID: "222222222222", Region: "us-east-1", AMI: "ami-1", ID: "ami-2"}
+
+	journal, err := OpenJournal(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Record(step); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	journal, err = OpenJournal(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	completed, ok := journal.Completed(JournalEntry{Step: "copy", TargetID: "222222222222", Region: "us-east-1", AMI: "ami-1"})
+	if !ok || completed.ID != "ami-2" {
+		t.Errorf("resumed journal has %+v, expected the copy ami-2", completed)
+	}
+
+	if err := journal.Record(JournalEntry{Step: "copy", TargetID: "222222222222", Region: "us-east-1", AMI: "ami-1", Undone: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := journal.Completed(step); ok {
+		t.Errorf("undone step still completed")
+	}
+}
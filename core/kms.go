@@ -0,0 +1,282 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/elastic/aws-ami-share/common"
+	"github.com/elastic/aws-ami-share/utils"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+const (
+	// Modes for managing access of target accounts to the KMS keys of encrypted AMIs
+	KMSAccessNone      = "none"
+	KMSAccessCheck     = "check"
+	KMSAccessGrant     = "grant"
+	KMSAccessKeyPolicy = "key-policy"
+
+	// Planned KMS actions
+	KMSActionAllowed      = "already-allowed"
+	KMSActionMissing      = "missing-access"
+	KMSActionAWSManaged   = "unsupported-aws-managed-key"
+	KMSActionCreateGrant  = "create-grant"
+	KMSActionAddStatement = "add-key-policy-statement"
+
+	KeyPolicyName = "default"
+)
+
+// Operations a target account needs on a KMS key to launch or copy an encrypted AMI
+var kmsShareOperations = []string{
+	kms.GrantOperationDecrypt,
+	kms.GrantOperationDescribeKey,
+	kms.GrantOperationReEncryptFrom,
+	kms.GrantOperationReEncryptTo,
+	kms.GrantOperationGenerateDataKeyWithoutPlaintext,
+	kms.GrantOperationCreateGrant,
+}
+
+type KMSAction struct {
+	KeyARN string `yaml:"key-arn" json:"key-arn"`
+	Region string `yaml:"region" json:"region"`
+	Action string `yaml:"action" json:"action"`
+}
+
+type keyPolicy struct {
+	Version   string                   `json:"Version"`
+	ID        string                   `json:"Id,omitempty"`
+	Statement []map[string]interface{} `json:"Statement"`
+}
+
+// Check that a KMS key (ID, ARN, alias name or alias ARN) exists and is enabled in the account and region
+func ValidateKMSKey(ctx context.Context, sessionFactory *utils.AWSSessionFactory, account *common.Account, region, kmsKeyId string) error {
+	logger := log.WithFields(log.Fields{
+		"profile":   account.ID,
+		"operation": "kms-key",
+	})
+
+	sess, err := sessionFactory.GetSession(ctx, AccountSessionKey(account, region))
+	if err != nil {
+		return err
+	}
+
+	keyOutput, err := kms.New(sess).DescribeKeyWithContext(ctx, &kms.DescribeKeyInput{KeyId: aws.String(kmsKeyId)})
+	if err != nil {
+		logger.Errorf("failed to describe KMS key %s in %s", kmsKeyId, region)
+		return err
+	}
+
+	if !aws.BoolValue(keyOutput.KeyMetadata.Enabled) {
+		return errors.New(fmt.Sprintf("KMS key %s is not enabled in account [%s], region [%s]",
+			kmsKeyId, account.Alias, region))
+	}
+
+	return nil
+}
+
+func KMSAccessModes() []string {
+	return []string{KMSAccessNone, KMSAccessCheck, KMSAccessGrant, KMSAccessKeyPolicy}
+}
+
+// Plan the action giving an account access to a KMS key of the source account, depending on the access mode
+func PlanKMSAction(ctx context.Context, sessionFactory *utils.AWSSessionFactory, source *common.Account, region, keyArn, accountId, mode string) (KMSAction, error) {
+	action := KMSAction{KeyARN: keyArn, Region: region}
+	sess, err := sessionFactory.GetSession(ctx, AccountSessionKey(source, region))
+	if err != nil {
+		return action, err
+	}
+	svc := kms.New(sess)
+
+	keyOutput, err := svc.DescribeKeyWithContext(ctx, &kms.DescribeKeyInput{KeyId: aws.String(keyArn)})
+	if err != nil {
+		return action, err
+	}
+	// Replica keys may be given as key IDs or aliases
+	action.KeyARN = aws.StringValue(keyOutput.KeyMetadata.Arn)
+	if aws.StringValue(keyOutput.KeyMetadata.KeyManager) == kms.KeyManagerTypeAws {
+		action.Action = KMSActionAWSManaged
+		return action, nil
+	}
+
+	allowed, err := accountHasKeyAccess(ctx, svc, action.KeyARN, accountId)
+	if err != nil {
+		return action, err
+	}
+
+	switch {
+	case allowed:
+		action.Action = KMSActionAllowed
+	case mode == KMSAccessGrant:
+		action.Action = KMSActionCreateGrant
+	case mode == KMSAccessKeyPolicy:
+		action.Action = KMSActionAddStatement
+	default:
+		action.Action = KMSActionMissing
+	}
+	return action, nil
+}
+
+// An account can use a key if the key policy allows it or if it was given a grant for decrypting
+func accountHasKeyAccess(ctx context.Context, svc *kms.KMS, keyArn, accountId string) (bool, error) {
+	policy, err := getKeyPolicy(ctx, svc, keyArn)
+	if err != nil {
+		return false, err
+	}
+	for _, statement := range policy.Statement {
+		if statement["Effect"] != "Allow" {
+			continue
+		}
+		principals, _ := statement["Principal"].(map[string]interface{})
+		if !containsAccount(stringValues(principals["AWS"]), accountId) {
+			continue
+		}
+		for _, action := range stringValues(statement["Action"]) {
+			if action == "kms:*" || action == "kms:Decrypt" {
+				return true, nil
+			}
+		}
+	}
+
+	allowed := false
+	err = svc.ListGrantsPagesWithContext(ctx, &kms.ListGrantsInput{KeyId: aws.String(keyArn)},
+		func(page *kms.ListGrantsResponse, lastPage bool) bool {
+			for _, grant := range page.Grants {
+				if !containsAccount([]string{aws.StringValue(grant.GranteePrincipal)}, accountId) {
+					continue
+				}
+				for _, operation := range grant.Operations {
+					if aws.StringValue(operation) == kms.GrantOperationDecrypt {
+						allowed = true
+						return false
+					}
+				}
+			}
+			return true
+		})
+	return allowed, err
+}
+
+// Run a planned KMS action for the target account through the source account session
+func ApplyKMSAction(ctx context.Context, sessionFactory *utils.AWSSessionFactory, source *common.Account, action KMSAction, accountId, alias string) error {
+	sess, err := sessionFactory.GetSession(ctx, AccountSessionKey(source, action.Region))
+	if err != nil {
+		return err
+	}
+	svc := kms.New(sess)
+	principal := fmt.Sprintf("arn:aws:iam::%s:root", accountId)
+
+	switch action.Action {
+	case KMSActionCreateGrant:
+		_, err = svc.CreateGrantWithContext(ctx, &kms.CreateGrantInput{
+			KeyId:            aws.String(action.KeyARN),
+			GranteePrincipal: aws.String(principal),
+			Name:             aws.String(fmt.Sprintf("%s-%s", ShareWithPrefix, alias)),
+			Operations:       aws.StringSlice(kmsShareOperations),
+		})
+		return err
+	case KMSActionAddStatement:
+		policy, err := getKeyPolicy(ctx, svc, action.KeyARN)
+		if err != nil {
+			return err
+		}
+		var actions []string
+		for _, operation := range kmsShareOperations {
+			actions = append(actions, "kms:"+operation)
+		}
+		policy.Statement = append(policy.Statement, map[string]interface{}{
+			"Sid":       fmt.Sprintf("%s-%s", ShareWithPrefix, alias),
+			"Effect":    "Allow",
+			"Principal": map[string]interface{}{"AWS": principal},
+			"Action":    actions,
+			"Resource":  "*",
+		})
+		raw, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		_, err = svc.PutKeyPolicyWithContext(ctx, &kms.PutKeyPolicyInput{
+			KeyId:      aws.String(action.KeyARN),
+			PolicyName: aws.String(KeyPolicyName),
+			Policy:     aws.String(string(raw)),
+		})
+		return err
+	}
+	return nil
+}
+
+func getKeyPolicy(ctx context.Context, svc *kms.KMS, keyArn string) (*keyPolicy, error) {
+	policyOutput, err := svc.GetKeyPolicyWithContext(ctx, &kms.GetKeyPolicyInput{
+		KeyId:      aws.String(keyArn),
+		PolicyName: aws.String(KeyPolicyName),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A single statement is not wrapped in a list
+	var raw struct {
+		Version   string          `json:"Version"`
+		ID        string          `json:"Id,omitempty"`
+		Statement json.RawMessage `json:"Statement"`
+	}
+	if err := json.Unmarshal([]byte(aws.StringValue(policyOutput.Policy)), &raw); err != nil {
+		return nil, err
+	}
+	policy := &keyPolicy{Version: raw.Version, ID: raw.ID}
+	if err := json.Unmarshal(raw.Statement, &policy.Statement); err != nil {
+		var statement map[string]interface{}
+		if err := json.Unmarshal(raw.Statement, &statement); err != nil {
+			return nil, err
+		}
+		policy.Statement = append(policy.Statement, statement)
+	}
+	return policy, nil
+}
+
+// Policy elements can either be a string or a list of strings
+func stringValues(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if str, ok := item.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Principals are either account IDs or ARNs in the account (arn:aws:iam::account-id:...)
+func containsAccount(principals []string, accountId string) bool {
+	for _, principal := range principals {
+		if principal == accountId || strings.HasPrefix(principal, fmt.Sprintf("arn:aws:iam::%s:", accountId)) {
+			return true
+		}
+	}
+	return false
+}
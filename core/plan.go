@@ -0,0 +1,459 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/aws-ami-share/common"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+)
+
+const (
+	// Version of the plan file format, bumped on incompatible changes
+	PlanFormatVersion = 2
+
+	PlanFormatYAML = "yaml"
+	PlanFormatJSON = "json"
+)
+
+// Copy of a shared AMI owned by the target account.
+// ID is only known once the plan has been applied
+type AMICopy struct {
+	Group    string `yaml:"group" json:"group"`
+	Region   string `yaml:"region" json:"region"`
+	SourceID string `yaml:"source-id" json:"source-id"`
+	KMSKeyID string `yaml:"kms-key-id,omitempty" json:"kms-key-id,omitempty"`
+	ID       string `yaml:"id,omitempty" json:"id,omitempty"`
+}
+
+type AMISharePlanAccount struct {
+	ID         string
+	Alias      string
+	AssumeRole string
+	AMIs       ImagesByGroup
+	Copies     []AMICopy
+	KMSActions []KMSAction
+	// unshare actions on target accounts, deregister actions on the source account
+	RetentionActions []RetentionAction
+	// IDs of the AMIs of a target account already shared with it, by launch permission
+	Shared map[string]bool
+}
+
+type AMISharePlanOrganization struct {
+	ARN   string
+	Alias string
+	AMIs  ImagesByGroup
+	// IDs of the AMIs already shared with the organization, by launch permission
+	Shared map[string]bool
+}
+
+// Copy of a source AMI into another region of the source account.
+// ID is only known once the plan has been applied
+type AMIReplication struct {
+	SourceRegion string `yaml:"source-region" json:"source-region"`
+	SourceID     string `yaml:"source-id" json:"source-id"`
+	Region       string `yaml:"region" json:"region"`
+	KMSKeyID     string `yaml:"kms-key-id,omitempty" json:"kms-key-id,omitempty"`
+	ID           string `yaml:"id,omitempty" json:"id,omitempty"`
+}
+
+// Plans are written as a PlanDocument, which describes the images
+type AMISharePlan struct {
+	ConfigHash                string
+	SourceAccount             AMISharePlanAccount
+	Replications              []AMIReplication
+	TargetAccounts            []AMISharePlanAccount
+	TargetOrganizations       []AMISharePlanOrganization
+	TargetOrganizationalUnits []AMISharePlanOrganization
+}
+
+// Structured view of the images of a plan, by group and region
+type PlanImagesByGroup map[string]map[string][]common.ImageDescription
+
+type PlanAccountDocument struct {
+	ID         string            `yaml:"id" json:"id"`
+	Alias      string            `yaml:"alias" json:"alias"`
+	AssumeRole string            `yaml:"assume-role" json:"assume-role"`
+	AMIs       PlanImagesByGroup `yaml:"amis" json:"amis"`
+	Copies     []AMICopy         `yaml:"copies,omitempty" json:"copies,omitempty"`
+	KMSActions []KMSAction       `yaml:"kms-actions,omitempty" json:"kms-actions,omitempty"`
+
+	RetentionActions []RetentionAction `yaml:"retention-actions,omitempty" json:"retention-actions,omitempty"`
+}
+
+type PlanOrganizationDocument struct {
+	ARN   string            `yaml:"arn" json:"arn"`
+	Alias string            `yaml:"alias" json:"alias"`
+	AMIs  PlanImagesByGroup `yaml:"amis" json:"amis"`
+}
+
+// The plan as written to the plan file
+type PlanDocument struct {
+	FormatVersion             int                        `yaml:"format-version" json:"format-version"`
+	ConfigHash                string                     `yaml:"config-hash" json:"config-hash"`
+	SourceAccount             PlanAccountDocument        `yaml:"source-account" json:"source-account"`
+	Replications              []AMIReplication           `yaml:"replications,omitempty" json:"replications,omitempty"`
+	TargetAccounts            []PlanAccountDocument      `yaml:"target-accounts" json:"target-accounts"`
+	TargetOrganizations       []PlanOrganizationDocument `yaml:"organizations,omitempty" json:"organizations,omitempty"`
+	TargetOrganizationalUnits []PlanOrganizationDocument `yaml:"organizational-units,omitempty" json:"organizational-units,omitempty"`
+	Integrity                 *PlanIntegrity             `yaml:"integrity,omitempty" json:"integrity,omitempty"`
+}
+
+func PlanFormats() []string {
+	return []string{PlanFormatYAML, PlanFormatJSON}
+}
+
+func (plan *AMISharePlan) Document() PlanDocument {
+	document := PlanDocument{
+		FormatVersion: PlanFormatVersion,
+		ConfigHash:    plan.ConfigHash,
+		SourceAccount: plan.SourceAccount.document(false),
+		Replications:  plan.Replications,
+	}
+	for _, account := range plan.TargetAccounts {
+		document.TargetAccounts = append(document.TargetAccounts, account.document(true))
+	}
+	for _, organization := range plan.TargetOrganizations {
+		document.TargetOrganizations = append(document.TargetOrganizations, organization.document())
+	}
+	for _, organizationalUnit := range plan.TargetOrganizationalUnits {
+		document.TargetOrganizationalUnits = append(document.TargetOrganizationalUnits, organizationalUnit.document())
+	}
+	return document
+}
+
+// Images of a target are described with the action planned for the target
+func (account *AMISharePlanAccount) document(target bool) PlanAccountDocument {
+	return PlanAccountDocument{
+		ID:               account.ID,
+		Alias:            account.Alias,
+		AssumeRole:       account.AssumeRole,
+		AMIs:             describeImages(account.AMIs, target, account.Shared),
+		Copies:           account.Copies,
+		KMSActions:       account.KMSActions,
+		RetentionActions: account.RetentionActions,
+	}
+}
+
+func (organization *AMISharePlanOrganization) document() PlanOrganizationDocument {
+	return PlanOrganizationDocument{
+		ARN:   organization.ARN,
+		Alias: organization.Alias,
+		AMIs:  describeImages(organization.AMIs, true, organization.Shared),
+	}
+}
+
+func describeImages(imagesByGroup ImagesByGroup, target bool, shared map[string]bool) PlanImagesByGroup {
+	described := make(PlanImagesByGroup)
+	for group, imagesByRegion := range imagesByGroup {
+		described[group] = make(map[string][]common.ImageDescription)
+		for region, images := range imagesByRegion {
+			descriptions := []common.ImageDescription{}
+			for _, image := range images {
+				description := image.Describe()
+				if target {
+					description.Action = common.ImageActionShare
+					if shared[image.String()] {
+						description.Action = common.ImageActionAlreadyShared
+					}
+				}
+				descriptions = append(descriptions, description)
+			}
+			described[group][region] = descriptions
+		}
+	}
+	return described
+}
+
+// Whether applying the plan would make any change
+func (document *PlanDocument) HasChanges() bool {
+	for _, replication := range document.Replications {
+		if replication.ID == "" {
+			return true
+		}
+	}
+	if hasRetentionChanges(document.SourceAccount.RetentionActions) {
+		return true
+	}
+	for _, account := range document.TargetAccounts {
+		if hasShares(account.AMIs) || hasRetentionChanges(account.RetentionActions) {
+			return true
+		}
+		for _, amiCopy := range account.Copies {
+			if amiCopy.ID == "" {
+				return true
+			}
+		}
+		for _, kmsAction := range account.KMSActions {
+			if kmsAction.Action == KMSActionCreateGrant || kmsAction.Action == KMSActionAddStatement {
+				return true
+			}
+		}
+	}
+	for _, organization := range append(document.TargetOrganizations, document.TargetOrganizationalUnits...) {
+		if hasShares(organization.AMIs) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasShares(described PlanImagesByGroup) bool {
+	for _, descriptionsByRegion := range described {
+		for _, descriptions := range descriptionsByRegion {
+			for _, description := range descriptions {
+				if description.Action == common.ImageActionShare {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func hasRetentionChanges(actions []RetentionAction) bool {
+	for _, action := range actions {
+		if action.Action != RetentionProtected {
+			return true
+		}
+	}
+	return false
+}
+
+// Load a plan written by WritePlan. The plan must have been generated from the same config.
+// Image handles are rebuilt by describing the AMIs of the plan in the source account
+func (shareAMI *AWSShareAMI) LoadPlan(ctx context.Context, path string) (*AMISharePlan, error) {
+	document, format, err := ReadPlanDocument(path)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the format for the run report
+	shareAMI.ShareParams.PlanFormat = format
+
+	if err := document.Verify(shareAMI.ShareParams.PlanPublicKey, shareAMI.ShareParams.RequireSignedPlan); err != nil {
+		return nil, &ValidationError{Err: errors.New(fmt.Sprintf("plan %s failed verification: %v", path, err))}
+	}
+
+	if document.ConfigHash != shareAMI.ShareParams.Config.Hash() {
+		return nil, &ValidationError{Err: errors.New(fmt.Sprintf("plan %s was not generated from this config: config hash does not match", path))}
+	}
+
+	images, err := shareAMI.loadImages(ctx, document)
+	if err != nil {
+		return nil, err
+	}
+
+	shareAMI.logger.Infof("Checking plan for drift")
+	drifts, err := shareAMI.DetectDrift(ctx, document, images)
+	if err != nil {
+		return nil, err
+	}
+	if shareAMI.ShareParams.Resume {
+		drifts = withoutResumedDrifts(drifts)
+	}
+	for _, drift := range drifts {
+		shareAMI.logger.Warnf("Drift of AMI %s[%s] for [%s] in region [%s]: %s (%s)",
+			drift.Group, drift.ID, drift.Target, drift.Region, drift.Kind, drift.Detail)
+	}
+	if len(drifts) > 0 {
+		if !shareAMI.ShareParams.AllowStale {
+			return nil, &ValidationError{Err: errors.New(fmt.Sprintf("plan %s is stale: %d AMIs drifted since the plan was written", path, len(drifts)))}
+		}
+		shareAMI.logger.Warnf("Applying stale plan: deregistered AMIs are skipped")
+	}
+
+	plan := &AMISharePlan{
+		ConfigHash:    document.ConfigHash,
+		SourceAccount: document.SourceAccount.plan(images),
+		Replications:  document.Replications,
+	}
+	for _, account := range document.TargetAccounts {
+		plan.TargetAccounts = append(plan.TargetAccounts, account.plan(images))
+	}
+	for _, organization := range document.TargetOrganizations {
+		plan.TargetOrganizations = append(plan.TargetOrganizations, organization.plan(images))
+	}
+	for _, organizationalUnit := range document.TargetOrganizationalUnits {
+		plan.TargetOrganizationalUnits = append(plan.TargetOrganizationalUnits, organizationalUnit.plan(images))
+	}
+	return plan, nil
+}
+
+// AMIs shared by the apply being resumed are expected to be shared already
+func withoutResumedDrifts(drifts []Drift) []Drift {
+	var remaining []Drift
+	for _, drift := range drifts {
+		if drift.Kind != DriftAlreadyShared {
+			remaining = append(remaining, drift)
+		}
+	}
+	return remaining
+}
+
+// Read a plan file, without loading its AMIs. Returns the document and the format of the file
+func ReadPlanDocument(path string) (*PlanDocument, string, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// JSON plans are valid YAML
+	format := PlanFormatYAML
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		format = PlanFormatJSON
+	}
+	var document PlanDocument
+	if err := yaml.Unmarshal(raw, &document); err != nil {
+		return nil, "", err
+	}
+
+	if document.FormatVersion != PlanFormatVersion {
+		return nil, "", &ValidationError{Err: errors.New(fmt.Sprintf("unsupported plan format-version %d: expected %d", document.FormatVersion, PlanFormatVersion))}
+	}
+	return &document, format, nil
+}
+
+// Describe all the AMIs of the plan in the source account, by ID.
+// AMIs deregistered since the plan was written are missing
+func (shareAMI *AWSShareAMI) loadImages(ctx context.Context, document *PlanDocument) (map[string]common.Image, error) {
+	idsByRegion := make(map[string][]string)
+	uniqueIds := make(map[string]struct{})
+	for _, imagesByGroup := range document.imageGroups() {
+		for _, imagesByRegion := range imagesByGroup {
+			for _, descriptions := range imagesByRegion {
+				for _, description := range descriptions {
+					if _, ok := uniqueIds[description.ID]; ok {
+						continue
+					}
+					uniqueIds[description.ID] = struct{}{}
+					idsByRegion[description.Region] = append(idsByRegion[description.Region], description.ID)
+				}
+			}
+		}
+	}
+
+	images := make(map[string]common.Image)
+	for region, ids := range idsByRegion {
+		sess, err := shareAMI.sessionFactory.GetSession(ctx, AccountSessionKey(&shareAMI.ShareParams.Config.SourceAccount, region))
+		if err != nil {
+			return images, err
+		}
+		regionImages, err := LoadAMIs(ctx, sess, ids, shareAMI.retryCall)
+		if err != nil {
+			return images, err
+		}
+		for _, image := range regionImages {
+			images[image.String()] = image
+		}
+	}
+	return images, nil
+}
+
+func (document *PlanDocument) imageGroups() []PlanImagesByGroup {
+	groups := []PlanImagesByGroup{document.SourceAccount.AMIs}
+	for _, account := range document.TargetAccounts {
+		groups = append(groups, account.AMIs)
+	}
+	for _, organization := range append(document.TargetOrganizations, document.TargetOrganizationalUnits...) {
+		groups = append(groups, organization.AMIs)
+	}
+	return groups
+}
+
+func (account *PlanAccountDocument) plan(images map[string]common.Image) AMISharePlanAccount {
+	return AMISharePlanAccount{
+		ID:               account.ID,
+		Alias:            account.Alias,
+		AssumeRole:       account.AssumeRole,
+		AMIs:             imagesFromDescriptions(account.AMIs, images),
+		Copies:           account.Copies,
+		KMSActions:       account.KMSActions,
+		RetentionActions: account.RetentionActions,
+		Shared:           sharedFromDescriptions(account.AMIs),
+	}
+}
+
+func (organization *PlanOrganizationDocument) plan(images map[string]common.Image) AMISharePlanOrganization {
+	return AMISharePlanOrganization{
+		ARN:    organization.ARN,
+		Alias:  organization.Alias,
+		AMIs:   imagesFromDescriptions(organization.AMIs, images),
+		Shared: sharedFromDescriptions(organization.AMIs),
+	}
+}
+
+// IDs of the AMIs planned as already shared with the target
+func sharedFromDescriptions(described PlanImagesByGroup) map[string]bool {
+	shared := make(map[string]bool)
+	for _, descriptionsByRegion := range described {
+		for _, descriptions := range descriptionsByRegion {
+			for _, description := range descriptions {
+				if description.Action == common.ImageActionAlreadyShared {
+					shared[description.ID] = true
+				}
+			}
+		}
+	}
+	return shared
+}
+
+func imagesFromDescriptions(described PlanImagesByGroup, images map[string]common.Image) ImagesByGroup {
+	imagesByGroup := make(ImagesByGroup)
+	for group, descriptionsByRegion := range described {
+		imagesByGroup[group] = make(ImagesByRegion)
+		for region, descriptions := range descriptionsByRegion {
+			var regionImages common.Images
+			for _, description := range descriptions {
+				if image, ok := images[description.ID]; ok {
+					regionImages = append(regionImages, image)
+				}
+			}
+			imagesByGroup[group][region] = regionImages
+		}
+	}
+	return imagesByGroup
+}
+
+func (shareAMI *AWSShareAMI) WritePlan(plan *AMISharePlan) error {
+	document := plan.Document()
+	if err := document.Seal(shareAMI.ShareParams.PlanSigningKey); err != nil {
+		return err
+	}
+
+	var raw []byte
+	var err error
+	if shareAMI.ShareParams.PlanFormat == PlanFormatJSON {
+		raw, err = json.MarshalIndent(document, "", "  ")
+	} else {
+		raw, err = yaml.Marshal(document)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(shareAMI.ShareParams.PlanFile, raw, 0644); err != nil {
+		return err
+	}
+	shareAMI.logger.Infof("Wrote plan to: %s", shareAMI.ShareParams.PlanFile)
+	return nil
+}
@@ -0,0 +1,79 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"sync"
+)
+
+const (
+	DefaultConcurrency       = 4
+	DefaultRegionConcurrency = 4
+)
+
+// Action of an apply, run in a region
+type applyTask struct {
+	region string
+	run    func()
+	// waits for the tasks the task depends on, if any. Tasks are queued in order: the tasks waited on must come first
+	wait func()
+}
+
+// Run the tasks with a pool of --concurrency workers, and at most --region-concurrency tasks at once in a region.
+// Tasks start in order. Returns when all tasks are done
+func (shareAMI *AWSShareAMI) runTasks(tasks []applyTask) {
+	concurrency := shareAMI.ShareParams.Concurrency
+	if concurrency < 1 {
+		concurrency = DefaultConcurrency
+	}
+	regionConcurrency := shareAMI.ShareParams.RegionConcurrency
+	if regionConcurrency < 1 {
+		regionConcurrency = DefaultRegionConcurrency
+	}
+
+	regionLimits := make(map[string]chan struct{})
+	for _, task := range tasks {
+		if _, ok := regionLimits[task.region]; !ok {
+			regionLimits[task.region] = make(chan struct{}, regionConcurrency)
+		}
+	}
+
+	queue := make(chan applyTask)
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for task := range queue {
+				// Waiting tasks do not hold a slot of their region, which the tasks they wait on may need
+				if task.wait != nil {
+					task.wait()
+				}
+				limit := regionLimits[task.region]
+				limit <- struct{}{}
+				task.run()
+				<-limit
+			}
+		}()
+	}
+	for _, task := range tasks {
+		queue <- task
+	}
+	close(queue)
+	workers.Wait()
+}
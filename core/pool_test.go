@@ -0,0 +1,67 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"github.com/elastic/aws-ami-share/common"
+	"sync"
+	"testing"
+)
+
+func TestRunTasksWait(t *testing.T) {
+	cases := []struct {
+		name              string
+		concurrency       int
+		regionConcurrency int
+	}{
+		{"one worker", 1, 1},
+		{"one slot per region", 4, 1},
+		{"default", 0, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			shareAMI := AWSShareAMI{ShareParams: &common.ShareParams{Concurrency: c.concurrency, RegionConcurrency: c.regionConcurrency}}
+			var mutex sync.Mutex
+			var order []string
+			record := func(name string) func() {
+				return func() {
+					mutex.Lock()
+					defer mutex.Unlock()
+					order = append(order, name)
+				}
+			}
+
+			// Waiting tasks must not hold the slot of their region needed by the task they wait on
+			done := make(chan struct{})
+			tasks := []applyTask{
+				{region: "eu-west-1", run: func() {
+					defer close(done)
+					record("replicate")()
+				}},
+			}
+			for i := 0; i < 4; i++ {
+				tasks = append(tasks, applyTask{region: "eu-west-1", run: record("share"), wait: func() { <-done }})
+			}
+			shareAMI.runTasks(tasks)
+
+			if len(order) != 5 || order[0] != "replicate" {
+				t.Errorf("tasks ran in order %v, expected the replication first", order)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"strings"
+	"text/template"
+)
+
+const (
+	RenderFormatMarkdown = "markdown"
+	RenderFormatHTML     = "html"
+)
+
+// Target of a plan, as rendered in reports
+type renderTarget struct {
+	Kind             string
+	Alias            string
+	ID               string
+	Rows             []summaryRow
+	Totals           summaryTotals
+	Copies           []AMICopy
+	KMSActions       []KMSAction
+	RetentionActions []RetentionAction
+}
+
+type renderPlan struct {
+	ConfigHash   string
+	Checksum     string
+	Signed       bool
+	Replications []AMIReplication
+	Retention    []RetentionAction
+	Targets      []renderTarget
+}
+
+func RenderFormats() []string {
+	return []string{RenderFormatMarkdown, RenderFormatHTML}
+}
+
+// Render a plan for reviews. The plan file stays the canonical artifact
+func RenderPlan(w io.Writer, document PlanDocument, format string) error {
+	view := newRenderPlan(document)
+	switch format {
+	case RenderFormatMarkdown:
+		return markdownTemplate.Execute(w, view)
+	case RenderFormatHTML:
+		return htmlTemplate.Execute(w, view)
+	}
+	return errors.New(fmt.Sprintf("invalid render format [%s]: expected one of %v", format, RenderFormats()))
+}
+
+func newRenderPlan(document PlanDocument) renderPlan {
+	view := renderPlan{
+		ConfigHash:   document.ConfigHash,
+		Replications: document.Replications,
+		Retention:    document.SourceAccount.RetentionActions,
+	}
+	if document.Integrity != nil {
+		view.Checksum = document.Integrity.Checksum
+		view.Signed = document.Integrity.Signature != ""
+	}
+	for _, account := range document.TargetAccounts {
+		rows := summaryRows(account.Alias, account.AMIs)
+		view.Targets = append(view.Targets, renderTarget{
+			Kind:             "account",
+			Alias:            account.Alias,
+			ID:               account.ID,
+			Rows:             rows,
+			Totals:           countActions(rows),
+			Copies:           account.Copies,
+			KMSActions:       account.KMSActions,
+			RetentionActions: account.RetentionActions,
+		})
+	}
+	for _, organization := range document.TargetOrganizations {
+		view.Targets = append(view.Targets, renderOrganization("organization", organization))
+	}
+	for _, organizationalUnit := range document.TargetOrganizationalUnits {
+		view.Targets = append(view.Targets, renderOrganization("organizational unit", organizationalUnit))
+	}
+	return view
+}
+
+func renderOrganization(kind string, organization PlanOrganizationDocument) renderTarget {
+	rows := summaryRows(organization.Alias, organization.AMIs)
+	return renderTarget{
+		Kind:   kind,
+		Alias:  organization.Alias,
+		ID:     organization.ARN,
+		Rows:   rows,
+		Totals: countActions(rows),
+	}
+}
+
+// Escape the characters breaking Markdown table cells. GitHub renders inline HTML, which is escaped as well
+func markdownCell(value string) string {
+	value = template.HTMLEscapeString(value)
+	value = strings.Replace(value, "|", "\\|", -1)
+	return strings.Replace(value, "\n", " ", -1)
+}
+
+var markdownTemplate = template.Must(template.New("markdown").Funcs(template.FuncMap{
+	"cell": markdownCell,
+}).Parse(`## AMI share plan
+
+Config hash: ` + "`{{ .ConfigHash }}`" + `{{ if .Checksum }} · Checksum: ` + "`{{ .Checksum }}`" + `{{ end }}{{ if .Signed }} · Signed{{ end }}
+
+| Target | Type | To share | Already shared | Skipped |
+| ------ | ---- | -------- | -------------- | ------- |
+{{ range .Targets }}| {{ cell .Alias }} | {{ .Kind }} | {{ .Totals.Shares }} | {{ .Totals.AlreadyShared }} | {{ .Totals.Skipped }} |
+{{ end }}
+{{- if .Replications }}
+<details>
+<summary><b>Source account</b> replications: {{ len .Replications }}</summary>
+
+| Source region | Source AMI | Region | KMS key | Replica |
+| ------------- | ---------- | ------ | ------- | ------- |
+{{ range .Replications }}| {{ .SourceRegion }} | {{ .SourceID }} | {{ .Region }} | {{ or .KMSKeyID "-" }} | {{ or .ID "-" }} |
+{{ end }}
+</details>
+{{ end }}
+{{- if .Retention }}
+<details>
+<summary><b>Source account</b> retention actions: {{ len .Retention }}</summary>
+
+| Group | Region | AMI | Action | Delete snapshots |
+| ----- | ------ | --- | ------ | ---------------- |
+{{ range .Retention }}| {{ cell .Group }} | {{ .Region }} | {{ .ID }} | {{ .Action }} | {{ .DeleteSnapshots }} |
+{{ end }}
+</details>
+{{ end }}
+{{- range .Targets }}
+<details>
+<summary><b>{{ cell .Alias }}</b> ({{ .Kind }} {{ cell .ID }}): {{ .Totals.Shares }} to share, {{ .Totals.AlreadyShared }} already shared, {{ .Totals.Skipped }} skipped</summary>
+
+| Group | Region | AMI | Name | Action |
+| ----- | ------ | --- | ---- | ------ |
+{{ range .Rows }}| {{ cell .Group }} | {{ .Region }} | {{ .ID }} | {{ cell .Name }} | {{ .Action }} |
+{{ end }}
+{{- if .Copies }}
+**Copies**
+
+| Group | Region | Source AMI | KMS key | Copy |
+| ----- | ------ | ---------- | ------- | ---- |
+{{ range .Copies }}| {{ cell .Group }} | {{ .Region }} | {{ .SourceID }} | {{ or .KMSKeyID "-" }} | {{ or .ID "-" }} |
+{{ end }}
+{{- end }}
+{{- if .KMSActions }}
+**KMS actions**
+
+| Region | Key | Action |
+| ------ | --- | ------ |
+{{ range .KMSActions }}| {{ .Region }} | {{ .KeyARN }} | {{ .Action }} |
+{{ end }}
+{{- end }}
+{{- if .RetentionActions }}
+**Retention actions**
+
+| Group | Region | AMI | Action |
+| ----- | ------ | --- | ------ |
+{{ range .RetentionActions }}| {{ cell .Group }} | {{ .Region }} | {{ .ID }} | {{ .Action }} |
+{{ end }}
+{{- end }}
+</details>
+{{ end -}}
+`))
+
+var htmlTemplate = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>AMI share plan</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #24292e; }
+table { border-collapse: collapse; margin: 0.5em 0 1em; }
+th, td { border: 1px solid #d1d5da; padding: 4px 10px; text-align: left; }
+th { background: #f6f8fa; }
+code, td.id { font-family: SFMono-Regular, Consolas, monospace; }
+details { margin: 0.5em 0; }
+summary { cursor: pointer; }
+.share { color: #22863a; }
+.skip { color: #b08800; }
+</style>
+</head>
+<body>
+<h1>AMI share plan</h1>
+<p>Config hash: <code>{{ .ConfigHash }}</code>{{ if .Checksum }}<br>Checksum: <code>{{ .Checksum }}</code>{{ end }}{{ if .Signed }}<br>Signed{{ end }}</p>
+<table>
+<tr><th>Target</th><th>Type</th><th>To share</th><th>Already shared</th><th>Skipped</th></tr>
+{{ range .Targets }}<tr><td>{{ .Alias }}</td><td>{{ .Kind }}</td><td>{{ .Totals.Shares }}</td><td>{{ .Totals.AlreadyShared }}</td><td>{{ .Totals.Skipped }}</td></tr>
+{{ end }}</table>
+{{ if .Replications }}<details>
+<summary><b>Source account</b> replications: {{ len .Replications }}</summary>
+<table>
+<tr><th>Source region</th><th>Source AMI</th><th>Region</th><th>KMS key</th><th>Replica</th></tr>
+{{ range .Replications }}<tr><td>{{ .SourceRegion }}</td><td class="id">{{ .SourceID }}</td><td>{{ .Region }}</td><td class="id">{{ or .KMSKeyID "-" }}</td><td class="id">{{ or .ID "-" }}</td></tr>
+{{ end }}</table>
+</details>
+{{ end }}{{ if .Retention }}<details>
+<summary><b>Source account</b> retention actions: {{ len .Retention }}</summary>
+<table>
+<tr><th>Group</th><th>Region</th><th>AMI</th><th>Action</th><th>Delete snapshots</th></tr>
+{{ range .Retention }}<tr><td>{{ .Group }}</td><td>{{ .Region }}</td><td class="id">{{ .ID }}</td><td>{{ .Action }}</td><td>{{ .DeleteSnapshots }}</td></tr>
+{{ end }}</table>
+</details>
+{{ end }}{{ range .Targets }}<details>
+<summary><b>{{ .Alias }}</b> ({{ .Kind }} {{ .ID }}): {{ .Totals.Shares }} to share, {{ .Totals.AlreadyShared }} already shared, {{ .Totals.Skipped }} skipped</summary>
+<table>
+<tr><th>Group</th><th>Region</th><th>AMI</th><th>Name</th><th>Action</th></tr>
+{{ range .Rows }}<tr class="{{ .Action }}"><td>{{ .Group }}</td><td>{{ .Region }}</td><td class="id">{{ .ID }}</td><td>{{ .Name }}</td><td>{{ .Action }}</td></tr>
+{{ end }}</table>
+{{ if .Copies }}<h4>Copies</h4>
+<table>
+<tr><th>Group</th><th>Region</th><th>Source AMI</th><th>KMS key</th><th>Copy</th></tr>
+{{ range .Copies }}<tr><td>{{ .Group }}</td><td>{{ .Region }}</td><td class="id">{{ .SourceID }}</td><td class="id">{{ or .KMSKeyID "-" }}</td><td class="id">{{ or .ID "-" }}</td></tr>
+{{ end }}</table>
+{{ end }}{{ if .KMSActions }}<h4>KMS actions</h4>
+<table>
+<tr><th>Region</th><th>Key</th><th>Action</th></tr>
+{{ range .KMSActions }}<tr><td>{{ .Region }}</td><td class="id">{{ .KeyARN }}</td><td>{{ .Action }}</td></tr>
+{{ end }}</table>
+{{ end }}{{ if .RetentionActions }}<h4>Retention actions</h4>
+<table>
+<tr><th>Group</th><th>Region</th><th>AMI</th><th>Action</th></tr>
+{{ range .RetentionActions }}<tr><td>{{ .Group }}</td><td>{{ .Region }}</td><td class="id">{{ .ID }}</td><td>{{ .Action }}</td></tr>
+{{ end }}</table>
+{{ end }}</details>
+{{ end }}</body>
+</html>
+`))
@@ -0,0 +1,97 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"bytes"
+	"github.com/elastic/aws-ami-share/common"
+	"strings"
+	"testing"
+)
+
+func TestMarkdownCell(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected string
+	}{
+		{"web", "web"},
+		{"web|app", "web\\|app"},
+		{"line\nbreak", "line break"},
+		{"<script>", "&lt;script&gt;"},
+	}
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			if cell := markdownCell(c.value); cell != c.expected {
+				t.Errorf("expected %q, got %q", c.expected, cell)
+			}
+		})
+	}
+}
+
+func TestRenderPlan(t *testing.T) {
+	document := PlanDocument{
+		ConfigHash: "sha256:0123",
+		Integrity:  &PlanIntegrity{Checksum: "sha256:4567", Signature: "c2lnbmF0dXJl"},
+		TargetAccounts: []PlanAccountDocument{{
+			ID:    "222222222222",
+			Alias: "integration|account",
+			AMIs: PlanImagesByGroup{"web": {"us-east-1": {
+				{ID: "ami-1", Name: "WebApp-1", Region: "us-east-1", Action: common.ImageActionShare},
+				{ID: "ami-2", Name: "<WebApp-2>", Region: "us-east-1", Action: common.ImageActionAlreadyShared},
+			}}},
+			Copies: []AMICopy{{Group: "web", Region: "us-east-1", SourceID: "ami-1"}},
+		}},
+		Replications: []AMIReplication{{SourceRegion: "us-east-1", SourceID: "ami-1", Region: "eu-west-1", KMSKeyID: "alias/replicas"}},
+	}
+
+	cases := []struct {
+		format   string
+		expected []string
+	}{
+		{RenderFormatMarkdown, []string{
+			"Config hash: `sha256:0123` · Checksum: `sha256:4567` · Signed",
+			"| integration\\|account | account | 1 | 1 | 0 |",
+			"| web | us-east-1 | ami-2 | &lt;WebApp-2&gt; | already-shared |",
+			"| us-east-1 | ami-1 | eu-west-1 | alias/replicas | - |",
+			"| web | us-east-1 | ami-1 | - | - |",
+		}},
+		{RenderFormatHTML, []string{
+			"<code>sha256:0123</code><br>Checksum: <code>sha256:4567</code><br>Signed",
+			"<tr><td>integration|account</td><td>account</td><td>1</td><td>1</td><td>0</td></tr>",
+			"<td>&lt;WebApp-2&gt;</td>",
+			"<td class=\"id\">alias/replicas</td>",
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.format, func(t *testing.T) {
+			var output bytes.Buffer
+			if err := RenderPlan(&output, document, c.format); err != nil {
+				t.Fatal(err)
+			}
+			for _, expected := range c.expected {
+				if !strings.Contains(output.String(), expected) {
+					t.Errorf("rendering does not contain %q:\n%s", expected, output.String())
+				}
+			}
+		})
+	}
+
+	if err := RenderPlan(&bytes.Buffer{}, document, "pdf"); err == nil {
+		t.Errorf("rendered an invalid format")
+	}
+}
@@ -0,0 +1,210 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Steps of an apply, as reported on failures
+const (
+	StepReplicate       = "replicate"
+	StepFindImage       = "find-image"
+	StepKMSAction       = "kms-action"
+	StepShare           = "share"
+	StepMarkerTags      = "add-marker-tags"
+	StepPostShareTags   = "add-post-share-tags"
+	StepSession         = "session"
+	StepCopyTags        = "copy-tags"
+	StepCopy            = "copy"
+	StepUnshare         = "unshare"
+	StepRemoveMarkerTag = "remove-marker-tags"
+	StepDeregister      = "deregister"
+
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	// the apply was canceled by a signal, its remaining steps were skipped
+	RunInterrupted = "interrupted"
+
+	// Suffix of the report written next to the plan by an interrupted apply without --report
+	ReportSuffix = ".report"
+)
+
+// Failed action of an apply. Code is the AWS error code, if any
+type ActionError struct {
+	Target   string `yaml:"target,omitempty" json:"target,omitempty"`
+	TargetID string `yaml:"target-id,omitempty" json:"target-id,omitempty"`
+	Region   string `yaml:"region,omitempty" json:"region,omitempty"`
+	Group    string `yaml:"group,omitempty" json:"group,omitempty"`
+	AMI      string `yaml:"ami,omitempty" json:"ami,omitempty"`
+	Step     string `yaml:"step" json:"step"`
+	Code     string `yaml:"code,omitempty" json:"code,omitempty"`
+	Message  string `yaml:"message" json:"message"`
+	Retries  int    `yaml:"retries,omitempty" json:"retries,omitempty"`
+}
+
+// Outcome of an apply, with every failed action
+type RunReport struct {
+	Started  time.Time `yaml:"started" json:"started"`
+	Finished time.Time `yaml:"finished" json:"finished"`
+	Status   string    `yaml:"status" json:"status"`
+	// retries of all actions, successful or not
+	Retries int           `yaml:"retries" json:"retries"`
+	Errors  []ActionError `yaml:"errors" json:"errors"`
+	// steps not started because the apply was interrupted
+	Skipped int `yaml:"skipped,omitempty" json:"skipped,omitempty"`
+	// aliases of the accounts rolled back with --atomic-per-account
+	RolledBack []string `yaml:"rolled-back,omitempty" json:"rolled-back,omitempty"`
+	// copies and replicas made by the apply, or by the apply being resumed
+	Copies       []CopyReport     `yaml:"copies,omitempty" json:"copies,omitempty"`
+	Replications []AMIReplication `yaml:"replications,omitempty" json:"replications,omitempty"`
+}
+
+// Copy made into a target account
+type CopyReport struct {
+	TargetID string `yaml:"target-id" json:"target-id"`
+	AMICopy  `yaml:",inline"`
+}
+
+func newRunReport() *RunReport {
+	return &RunReport{Started: time.Now(), Errors: []ActionError{}}
+}
+
+// Record an action which failed while applying the plan. Apply goes on with the next actions
+func (shareAMI *AWSShareAMI) actionFailed(action ActionError, step string, err error) {
+	action.Step = step
+	action.Message = err.Error()
+	if awsErr, ok := err.(awserr.Error); ok {
+		action.Code = awsErr.Code()
+		action.Message = awsErr.Message()
+	}
+
+	shareAMI.mutex.Lock()
+	shareAMI.report.Errors = append(shareAMI.report.Errors, action)
+	shareAMI.markFailed(action.TargetID)
+	shareAMI.mutex.Unlock()
+	shareAMI.logger.Errorf("Failed step %s of AMI %s[%s] for [%s] in region [%s]. Error: %s", step, action.Group, action.AMI, action.TargetID, action.Region, err)
+}
+
+// Record a copy made into a target account in the report
+func (shareAMI *AWSShareAMI) reportCopy(targetID string, amiCopy AMICopy) {
+	shareAMI.mutex.Lock()
+	defer shareAMI.mutex.Unlock()
+	shareAMI.report.Copies = append(shareAMI.report.Copies, CopyReport{TargetID: targetID, AMICopy: amiCopy})
+}
+
+// Complete the report of the apply, then write it to the report file and print its summary
+func (shareAMI *AWSShareAMI) finishReport(ctx context.Context) error {
+	report := shareAMI.report
+	report.Finished = time.Now()
+	report.Status = RunSucceeded
+	if len(report.Errors) > 0 {
+		report.Status = RunFailed
+	}
+	if ctx.Err() != nil {
+		report.Status = RunInterrupted
+	}
+
+	// The report of an interrupted apply is always written, it lists the skipped steps
+	if shareAMI.ShareParams.ReportFile == "" && report.Status == RunInterrupted {
+		shareAMI.ShareParams.ReportFile = shareAMI.ShareParams.PlanFile + ReportSuffix
+	}
+	if shareAMI.ShareParams.ReportFile != "" {
+		if err := shareAMI.WriteReport(report); err != nil {
+			return err
+		}
+	}
+	if !shareAMI.ShareParams.Quiet {
+		if err := WriteReportSummary(os.Stdout, report); err != nil {
+			return err
+		}
+	}
+	if report.Status == RunInterrupted {
+		return &InterruptedError{Failures: len(report.Errors), Skipped: report.Skipped}
+	}
+	if len(report.Errors) > 0 {
+		return &PartialApplyError{Failures: len(report.Errors)}
+	}
+	return nil
+}
+
+// Write the report to the report file, in the format of the plan
+func (shareAMI *AWSShareAMI) WriteReport(report *RunReport) error {
+	var raw []byte
+	var err error
+	if shareAMI.ShareParams.PlanFormat == PlanFormatJSON {
+		raw, err = json.MarshalIndent(report, "", "  ")
+	} else {
+		raw, err = yaml.Marshal(report)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(shareAMI.ShareParams.ReportFile, raw, 0644); err != nil {
+		return err
+	}
+	shareAMI.logger.Infof("Wrote run report to: %s", shareAMI.ShareParams.ReportFile)
+	return nil
+}
+
+// Write the outcome of the apply, followed by a table of the failed actions
+func WriteReportSummary(w io.Writer, report *RunReport) error {
+	fmt.Fprintf(w, "\nApply %s in %s: %d failed actions, %d retries\n", report.Status,
+		report.Finished.Sub(report.Started).Round(time.Second), len(report.Errors), report.Retries)
+	if report.Status == RunInterrupted {
+		fmt.Fprintf(w, "Skipped %d steps: apply again with --resume to run them\n", report.Skipped)
+	}
+	if len(report.RolledBack) > 0 {
+		fmt.Fprintf(w, "Rolled back accounts: %s\n", strings.Join(report.RolledBack, ", "))
+	}
+	for _, replication := range report.Replications {
+		fmt.Fprintf(w, "Replicated AMI %s into [%s]: %s\n", replication.SourceID, replication.Region, replication.ID)
+	}
+	for _, amiCopy := range report.Copies {
+		fmt.Fprintf(w, "Copied AMI %s into [%s] in [%s]: %s\n", amiCopy.SourceID, amiCopy.TargetID, amiCopy.Region, amiCopy.ID)
+	}
+	if len(report.Errors) < 1 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tREGION\tGROUP\tAMI\tSTEP\tCODE\tRETRIES\tERROR")
+	for _, action := range report.Errors {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", orDash(action.Target), orDash(action.Region),
+			orDash(action.Group), orDash(action.AMI), action.Step, orDash(action.Code), action.Retries, action.Message)
+	}
+	return tw.Flush()
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,261 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/elastic/aws-ami-share/common"
+	"sort"
+	"time"
+)
+
+const (
+	// Planned retention actions
+	RetentionUnshare    = "unshare"
+	RetentionDeregister = "deregister"
+	RetentionProtected  = "protected"
+)
+
+type RetentionAction struct {
+	Group           string `yaml:"group" json:"group"`
+	Region          string `yaml:"region" json:"region"`
+	ID              string `yaml:"id" json:"id"`
+	Action          string `yaml:"action" json:"action"`
+	DeleteSnapshots bool   `yaml:"delete-snapshots,omitempty" json:"delete-snapshots,omitempty"`
+}
+
+// Plan unsharing the versions of the selected AMIs which are expired for the account.
+// Only AMIs marked as shared with the account are unshared, and never the AMIs the plan shares with it
+func PlanUnshares(sourceImages ImagesByRegion, account common.Account, imagesToShare ImagesByGroup, now time.Time) []RetentionAction {
+	inUse := make(map[string]struct{})
+	addImageIDs(inUse, imagesToShare)
+
+	var actions []RetentionAction
+	for group, selection := range account.AMIs {
+		if selection.Retention == nil {
+			continue
+		}
+		unshareAfter, _ := common.ParseRetentionDuration(selection.Retention.UnshareAfter)
+		if unshareAfter == 0 && selection.Retention.KeepLatest == 0 {
+			continue
+		}
+		for _, region := range account.SelectionRegions(group) {
+			for _, image := range expiredImages(sourceImages[region], selection, unshareAfter, now) {
+				if _, ok := inUse[image.String()]; ok || !image.IsSharedWith(account.Alias) {
+					continue
+				}
+				actions = append(actions, retentionAction(group, region, image, RetentionUnshare, selection.Retention))
+			}
+		}
+	}
+	sortRetentionActions(actions)
+	return actions
+}
+
+// Plan deregistering the versions of the selected AMIs which are expired in the source account.
+// AMIs planned to be shared with any target are never deregistered, nor AMIs which are not expired
+// under every selection matching them
+func PlanDeregistrations(sourceImages ImagesByRegion, plan *AMISharePlan, config *common.Config, now time.Time) []RetentionAction {
+	inUse := make(map[string]struct{})
+	for _, account := range plan.TargetAccounts {
+		addImageIDs(inUse, account.AMIs)
+	}
+	for _, organization := range append(plan.TargetOrganizations, plan.TargetOrganizationalUnits...) {
+		addImageIDs(inUse, organization.AMIs)
+	}
+
+	var actions []RetentionAction
+	planned := make(map[string]struct{})
+	selections := targetSelections(config)
+	for _, account := range config.TargetAccounts {
+		for group, selection := range account.AMIs {
+			if selection.Retention == nil || selection.Retention.DeregisterAfter == "" {
+				continue
+			}
+			deregisterAfter, _ := common.ParseRetentionDuration(selection.Retention.DeregisterAfter)
+			for _, region := range account.SelectionRegions(group) {
+				for _, image := range expiredImages(sourceImages[region], selection, deregisterAfter, now) {
+					if _, ok := inUse[image.String()]; ok {
+						continue
+					}
+					if _, ok := planned[image.String()]; ok {
+						continue
+					}
+					if !expiredForAll(selections, sourceImages[region], region, image, now) {
+						continue
+					}
+					planned[image.String()] = struct{}{}
+					actions = append(actions, retentionAction(group, region, image, RetentionDeregister, selection.Retention))
+				}
+			}
+		}
+	}
+	sortRetentionActions(actions)
+	return actions
+}
+
+func addImageIDs(ids map[string]struct{}, imagesByGroup ImagesByGroup) {
+	for _, imagesByRegion := range imagesByGroup {
+		for _, images := range imagesByRegion {
+			for _, image := range images {
+				ids[image.String()] = struct{}{}
+			}
+		}
+	}
+}
+
+// Selection of AMIs of a target account or organization, with the regions it uses
+type targetSelection struct {
+	selection common.AMISelection
+	regions   []string
+}
+
+// Selections of all targets. A selection uses the regions it is shared in and its source region
+func targetSelections(config *common.Config) []targetSelection {
+	var selections []targetSelection
+	for _, account := range config.TargetAccounts {
+		for group, selection := range account.AMIs {
+			selections = append(selections, newTargetSelection(selection, account.SelectionRegions(group)))
+		}
+	}
+	for _, organization := range config.Organizations() {
+		for _, selection := range organization.AMIs {
+			regions := selection.Regions
+			if len(regions) < 1 {
+				regions = organization.Regions
+			}
+			selections = append(selections, newTargetSelection(selection, regions))
+		}
+	}
+	return selections
+}
+
+func newTargetSelection(selection common.AMISelection, regions []string) targetSelection {
+	if selection.SourceRegion != "" {
+		regions = append(append([]string{}, regions...), selection.SourceRegion)
+	}
+	return targetSelection{selection: selection, regions: regions}
+}
+
+// Whether the image is expired under every selection matching it in the region.
+// Selections without deregister-after keep the AMIs they match
+func expiredForAll(selections []targetSelection, images common.Images, region string, image common.Image, now time.Time) bool {
+	for _, target := range selections {
+		if !containsRegion(target.regions, region) || len(common.MatchFilters(common.Images{image}, target.selection.Filters)) < 1 {
+			continue
+		}
+		retention := target.selection.Retention
+		if retention == nil || retention.DeregisterAfter == "" {
+			return false
+		}
+		deregisterAfter, _ := common.ParseRetentionDuration(retention.DeregisterAfter)
+		if common.FindImage(expiredImages(images, target.selection, deregisterAfter, now), image.String()) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func containsRegion(regions []string, region string) bool {
+	for _, r := range regions {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
+
+// Matching AMIs which are neither among the latest ones to keep nor younger than the given age
+func expiredImages(images common.Images, selection common.AMISelection, age time.Duration, now time.Time) common.Images {
+	matching := common.MatchFilters(images, selection.Filters)
+	keep := selection.Retention.KeepLatest
+	if keep >= len(matching) {
+		return nil
+	}
+
+	var expired common.Images
+	for _, image := range matching[:len(matching)-keep] {
+		if age > 0 && now.Sub(image.Date()) < age {
+			continue
+		}
+		expired = append(expired, image)
+	}
+	return expired
+}
+
+func retentionAction(group, region string, image common.Image, action string, retention *common.Retention) RetentionAction {
+	if image.Match(retention.ProtectFilter()) {
+		action = RetentionProtected
+	}
+	return RetentionAction{
+		Group:           group,
+		Region:          region,
+		ID:              image.String(),
+		Action:          action,
+		DeleteSnapshots: action == RetentionDeregister && retention.DeleteSnapshots,
+	}
+}
+
+func sortRetentionActions(actions []RetentionAction) {
+	sort.Slice(actions, func(i, j int) bool {
+		return fmt.Sprint(actions[i].Group, actions[i].Region, actions[i].ID) <
+			fmt.Sprint(actions[j].Group, actions[j].Region, actions[j].ID)
+	})
+}
+
+// Run a planned unshare action of a target account. Unsharing also removes the meta tag of the account
+func (shareAMI *AWSShareAMI) ApplyUnshare(ctx context.Context, account *AMISharePlanAccount, action RetentionAction, sourceImages ImagesByRegion) {
+	if action.Action != RetentionUnshare {
+		return
+	}
+	failed := ActionError{Target: account.Alias, TargetID: account.ID, Region: action.Region, Group: action.Group, AMI: action.ID}
+	image := common.FindImage(sourceImages[action.Region], action.ID)
+	if image == nil {
+		shareAMI.actionFailed(failed, StepFindImage, errors.New("AMI to unshare not found"))
+		return
+	}
+
+	shareAMI.logger.Infof("Unsharing AMI %s[%s] with account [%s] in region [%s]", action.Group, action.ID, account.ID, action.Region)
+	if !shareAMI.runStep(ctx, failed, StepUnshare, func(ctx context.Context) error {
+		return image.UnshareWithAccount(ctx, account.ID, shareAMI.ShareParams.ShareSnapshots)
+	}) {
+		return
+	}
+	shareAMI.runStep(ctx, failed, StepRemoveMarkerTag, func(ctx context.Context) error {
+		return image.RemoveTags(ctx, []string{ShareWithTag(account.Alias)}, shareAMI.ShareParams.ShareSnapshots)
+	})
+}
+
+// Run a planned deregister action of the source account
+func (shareAMI *AWSShareAMI) ApplyDeregistration(ctx context.Context, account *AMISharePlanAccount, action RetentionAction, sourceImages ImagesByRegion) {
+	if action.Action != RetentionDeregister {
+		return
+	}
+	failed := ActionError{Target: account.Alias, TargetID: account.ID, Region: action.Region, Group: action.Group, AMI: action.ID}
+	// Deregistered AMIs are missing when resuming: they are looked up once the journal was checked
+	shareAMI.runStep(ctx, failed, StepDeregister, func(ctx context.Context) error {
+		image := common.FindImage(sourceImages[action.Region], action.ID)
+		if image == nil {
+			return errors.New("AMI to deregister not found")
+		}
+		shareAMI.logger.Infof("Deregistering AMI %s[%s] in region [%s]", action.Group, action.ID, action.Region)
+		return image.Deregister(ctx, action.DeleteSnapshots)
+	})
+}
@@ -0,0 +1,245 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/elastic/aws-ami-share/common"
+	"github.com/rebuy-de/aws-nuke/pkg/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Image of the source account, without AWS access
+type fakeImage struct {
+	id     string
+	region string
+	date   time.Time
+	tags   map[string]string
+	state  string
+	// aliases of the targets the image is marked as shared with
+	sharedWith []string
+	// principals of the launch permissions of the image
+	launchPermissions []string
+}
+
+func (f *fakeImage) Properties() types.Properties {
+	properties := types.NewProperties()
+	for key, value := range f.tags {
+		properties.SetTag(&key, value)
+	}
+	properties.Set("ID", f.id)
+	return properties
+}
+
+func (f *fakeImage) Match(filter common.Filter) bool {
+	value := f.Properties().Get(filter.Property)
+	if filter.Invert {
+		return value != filter.Value
+	}
+	return value == filter.Value
+}
+
+func (f *fakeImage) Date() time.Time { return f.date }
+func (f *fakeImage) Region() string  { return f.region }
+func (f *fakeImage) String() string  { return f.id }
+func (f *fakeImage) IsSharedWith(alias string) bool {
+	for _, shared := range f.sharedWith {
+		if shared == alias {
+			return true
+		}
+	}
+	return false
+}
+func (f *fakeImage) Describe() common.ImageDescription {
+	return common.ImageDescription{ID: f.id, Region: f.region, CreationDate: f.date.Format(time.RFC3339), State: f.state}
+}
+func (f *fakeImage) LaunchPermissions(context.Context) ([]string, error) {
+	return f.launchPermissions, nil
+}
+func (f *fakeImage) AddTags(context.Context, map[string]string, bool) error          { return nil }
+func (f *fakeImage) RemoveTags(context.Context, []string, bool) error                { return nil }
+func (f *fakeImage) ShareWithAccount(context.Context, string, bool) error            { return nil }
+func (f *fakeImage) ShareSnapshotsWithAccount(context.Context, string) error         { return nil }
+func (f *fakeImage) ShareWithOrganization(context.Context, string, bool) error       { return nil }
+func (f *fakeImage) ShareWithOrganizationalUnit(context.Context, string, bool) error { return nil }
+func (f *fakeImage) UnshareWithAccount(context.Context, string, bool) error          { return nil }
+func (f *fakeImage) UnshareSnapshotsWithAccount(context.Context, string) error       { return nil }
+func (f *fakeImage) Deregister(context.Context, bool) error                          { return nil }
+func (f *fakeImage) CopyTags(context.Context, *session.Session, bool) error          { return nil }
+func (f *fakeImage) CopyToAccount(context.Context, *session.Session, string, string) (string, error) {
+	return "", nil
+}
+func (f *fakeImage) Replicate(context.Context, *session.Session, string, string) (string, error) {
+	return "", nil
+}
+func (f *fakeImage) CompleteCopy(context.Context, *session.Session, string) error { return nil }
+func (f *fakeImage) SnapshotsSharedWithAccount(context.Context, string) (bool, error) {
+	return false, nil
+}
+func (f *fakeImage) KMSKeys(context.Context) ([]string, error) { return nil, nil }
+
+// Versions of the web AMI in us-east-1, one per day from the oldest, marked as shared with the account "a"
+func fakeWebImages(now time.Time, days ...int) common.Images {
+	var images common.Images
+	for _, day := range days {
+		images = append(images, &fakeImage{
+			id:         "ami-" + now.AddDate(0, 0, -day).Format("20060102"),
+			region:     "us-east-1",
+			date:       now.AddDate(0, 0, -day),
+			tags:       map[string]string{"Name": "web"},
+			sharedWith: []string{"a"},
+		})
+	}
+	return images
+}
+
+func webSelection(retention *common.Retention) common.AMISelection {
+	return common.AMISelection{
+		Filters:   []common.Filter{{Property: "tag:Name", Value: "web"}},
+		Retention: retention,
+	}
+}
+
+func TestPlanDeregistrations(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	images := fakeWebImages(now, 100, 60, 10)
+	deregisterAfter90d := webSelection(&common.Retention{DeregisterAfter: "90d"})
+
+	cases := []struct {
+		name     string
+		config   common.Config
+		expected []string
+	}{
+		{
+			name: "expired for the only selection",
+			config: common.Config{TargetAccounts: []common.Account{
+				{Alias: "a", Regions: []string{"us-east-1"}, AMIs: map[string]common.AMISelection{"web": deregisterAfter90d}},
+			}},
+			expected: []string{"ami-20200222"},
+		},
+		{
+			name: "kept by a selection without retention",
+			config: common.Config{TargetAccounts: []common.Account{
+				{Alias: "a", Regions: []string{"us-east-1"}, AMIs: map[string]common.AMISelection{"web": deregisterAfter90d}},
+				{Alias: "b", Regions: []string{"us-east-1"}, AMIs: map[string]common.AMISelection{"web": webSelection(nil)}},
+			}},
+		},
+		{
+			name: "kept by a selection with a larger keep-latest",
+			config: common.Config{TargetAccounts: []common.Account{
+				{Alias: "a", Regions: []string{"us-east-1"}, AMIs: map[string]common.AMISelection{"web": deregisterAfter90d}},
+				{Alias: "b", Regions: []string{"us-east-1"}, AMIs: map[string]common.AMISelection{
+					"web": webSelection(&common.Retention{KeepLatest: 3, DeregisterAfter: "1d"}),
+				}},
+			}},
+		},
+		{
+			name: "kept by a selection with a longer deregister-after",
+			config: common.Config{TargetAccounts: []common.Account{
+				{Alias: "a", Regions: []string{"us-east-1"}, AMIs: map[string]common.AMISelection{"web": deregisterAfter90d}},
+				{Alias: "b", Regions: []string{"us-east-1"}, AMIs: map[string]common.AMISelection{
+					"web": webSelection(&common.Retention{DeregisterAfter: "120d"}),
+				}},
+			}},
+		},
+		{
+			name: "kept by an organization",
+			config: common.Config{
+				TargetAccounts: []common.Account{
+					{Alias: "a", Regions: []string{"us-east-1"}, AMIs: map[string]common.AMISelection{"web": deregisterAfter90d}},
+				},
+				TargetOrganizations: []common.Organization{
+					{Alias: "org", Regions: []string{"us-east-1"}, AMIs: map[string]common.AMISelection{"web": webSelection(nil)}},
+				},
+			},
+		},
+		{
+			name: "not kept by a selection of another region",
+			config: common.Config{TargetAccounts: []common.Account{
+				{Alias: "a", Regions: []string{"us-east-1"}, AMIs: map[string]common.AMISelection{"web": deregisterAfter90d}},
+				{Alias: "b", Regions: []string{"eu-west-1"}, AMIs: map[string]common.AMISelection{"web": webSelection(nil)}},
+			}},
+			expected: []string{"ami-20200222"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actions := PlanDeregistrations(ImagesByRegion{"us-east-1": images}, &AMISharePlan{}, &c.config, now)
+			if ids := actionIDs(actions, RetentionDeregister); !reflect.DeepEqual(ids, c.expected) {
+				t.Errorf("expected %v to be deregistered, got %v", c.expected, ids)
+			}
+		})
+	}
+}
+
+func TestPlanUnshares(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	images := fakeWebImages(now, 100, 60, 40)
+	latest := ImagesByGroup{"web": {"us-east-1": images[2:]}}
+
+	cases := []struct {
+		name          string
+		retention     *common.Retention
+		imagesToShare ImagesByGroup
+		expected      []string
+	}{
+		{
+			name:      "expired",
+			retention: &common.Retention{UnshareAfter: "50d"},
+			expected:  []string{"ami-20200222", "ami-20200402"},
+		},
+		{
+			name:          "shared by the plan",
+			retention:     &common.Retention{UnshareAfter: "30d"},
+			imagesToShare: latest,
+			expected:      []string{"ami-20200222", "ami-20200402"},
+		},
+		{
+			name:      "kept latest",
+			retention: &common.Retention{KeepLatest: 2},
+			expected:  []string{"ami-20200222"},
+		},
+		{
+			name: "without retention",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			account := common.Account{Alias: "a", Regions: []string{"us-east-1"}, AMIs: map[string]common.AMISelection{
+				"web": webSelection(c.retention),
+			}}
+			actions := PlanUnshares(ImagesByRegion{"us-east-1": images}, account, c.imagesToShare, now)
+			if ids := actionIDs(actions, RetentionUnshare); !reflect.DeepEqual(ids, c.expected) {
+				t.Errorf("expected %v to be unshared, got %v", c.expected, ids)
+			}
+		})
+	}
+}
+
+func actionIDs(actions []RetentionAction, action string) []string {
+	var ids []string
+	for _, planned := range actions {
+		if planned.Action == action {
+			ids = append(ids, planned.ID)
+		}
+	}
+	return ids
+}
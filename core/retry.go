@@ -0,0 +1,137 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// Transient errors retried on top of the throttling and transient errors known to the SDK
+	retryableCodes = map[string]bool{
+		"RequestLimitExceeded": true,
+		"Throttling":           true,
+		"InternalError":        true,
+		"Unavailable":          true,
+		"ServiceUnavailable":   true,
+	}
+
+	jitter      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterMutex sync.Mutex
+)
+
+// Whether the error is a throttling or transient error of the AWS APIs. Other errors are fatal,
+// the SDK would consider errors unknown to it as retryable
+func IsRetryable(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	return retryableCodes[awsErr.Code()] || request.IsErrorThrottle(err) || request.IsErrorRetryable(err)
+}
+
+// Run an action of the apply, retrying retryable errors with jittered exponential backoff,
+// until the attempts or the total time of the retry policy run out, or the apply is interrupted.
+// The action runs with a step context, so it is not canceled half way. Returns the number of retries
+func (shareAMI *AWSShareAMI) withRetries(ctx context.Context, action ActionError, step string, run func(context.Context) error) (int, error) {
+	return shareAMI.retryStep(ctx, action, step, func() error { return run(stepContext{ctx}) })
+}
+
+// Retry a step of the apply, logging its retries. The context of the step is up to the caller
+func (shareAMI *AWSShareAMI) retryStep(ctx context.Context, action ActionError, step string, run func() error) (int, error) {
+	return shareAMI.retry(ctx, run, func(delay time.Duration, err error) {
+		shareAMI.logger.Warnf("Retrying step %s of AMI [%s] for [%s] in region [%s] in %s. Error: %s",
+			step, action.AMI, action.TargetID, action.Region, delay.Round(time.Millisecond), err)
+	})
+}
+
+// Runs a read-only call with the retry policy of the run. The call is named in the retry logs
+type Retry func(ctx context.Context, call string, run func(context.Context) error) error
+
+// Run a read-only call of the plan or of the apply with the retry policy. Unlike the actions of the apply,
+// the call is canceled when interrupted
+func (shareAMI *AWSShareAMI) retryCall(ctx context.Context, call string, run func(context.Context) error) error {
+	_, err := shareAMI.retry(ctx, func() error { return run(ctx) }, func(delay time.Duration, err error) {
+		shareAMI.logger.Warnf("Retrying %s in %s. Error: %s", call, delay.Round(time.Millisecond), err)
+	})
+	return err
+}
+
+// Retry loop of the retry policy. The SDK does not retry on its own, see utils.AWSSessionFactory
+func (shareAMI *AWSShareAMI) retry(ctx context.Context, run func() error, logRetry func(time.Duration, error)) (int, error) {
+	started := time.Now()
+	retries := 0
+	for {
+		err := run()
+		if err == nil || !IsRetryable(err) {
+			return retries, err
+		}
+		policy := shareAMI.ShareParams.Config.Retry
+		if retries+1 >= policy.Attempts() {
+			return retries, err
+		}
+
+		baseDelay, maxDelay, maxElapsed := policy.Delays()
+		delay := backoff(baseDelay, maxDelay, retries)
+		if time.Now().Add(delay).After(started.Add(maxElapsed)) {
+			return retries, err
+		}
+		logRetry(delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return retries, err
+		}
+
+		retries++
+		shareAMI.mutex.Lock()
+		// Calls of the plan run before the report of the apply
+		if shareAMI.report != nil {
+			shareAMI.report.Retries++
+		}
+		shareAMI.mutex.Unlock()
+	}
+}
+
+// Client token of a call starting a copy, the same for all retries of the call. It is unique to the run,
+// so a copy deregistered since an earlier run is not returned again by an idempotent call
+func newClientToken(step JournalEntry) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s/%d", step.Key(), time.Now().UnixNano()))))
+}
+
+// Full jitter: a random delay up to the base delay doubled on each retry, capped to the maximum delay
+func backoff(baseDelay, maxDelay time.Duration, retries int) time.Duration {
+	delay := maxDelay
+	if retries < 32 && baseDelay<<uint(retries) < maxDelay {
+		delay = baseDelay << uint(retries)
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	jitterMutex.Lock()
+	defer jitterMutex.Unlock()
+	return time.Duration(jitter.Int63n(int64(delay)) + 1)
+}
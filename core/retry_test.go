@@ -0,0 +1,114 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/elastic/aws-ami-share/common"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	baseDelay, maxDelay := 100*time.Millisecond, time.Second
+	cases := []struct {
+		retries int
+		limit   time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{40, time.Second},
+	}
+	for _, c := range cases {
+		for i := 0; i < 100; i++ {
+			delay := backoff(baseDelay, maxDelay, c.retries)
+			if delay <= 0 || delay > c.limit {
+				t.Fatalf("backoff after %d retries is %s, expected up to %s", c.retries, delay, c.limit)
+			}
+		}
+	}
+	if delay := backoff(0, 0, 1); delay != 0 {
+		t.Errorf("backoff without delays is %s", delay)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{awserr.New("RequestLimitExceeded", "", nil), true},
+		{awserr.New("Throttling", "", nil), true},
+		{awserr.New("InternalError", "", nil), true},
+		{awserr.New("InvalidAMIID.NotFound", "", nil), false},
+		{awserr.New("UnauthorizedOperation", "", nil), false},
+		{errors.New("RequestLimitExceeded"), false},
+	}
+	for _, c := range cases {
+		if retryable := IsRetryable(c.err); retryable != c.retryable {
+			t.Errorf("IsRetryable(%v) is %v, expected %v", c.err, retryable, c.retryable)
+		}
+	}
+}
+
+func TestRetryCall(t *testing.T) {
+	config := &common.Config{Retry: common.RetryPolicy{MaxAttempts: 3, BaseDelay: "1ms", MaxDelay: "1ms"}}
+	cases := []struct {
+		name     string
+		errs     []error
+		attempts int
+		failed   bool
+	}{
+		{"succeeds", nil, 1, false},
+		{"retries throttling", []error{awserr.New("Throttling", "", nil)}, 2, false},
+		{"fails at once", []error{awserr.New("UnauthorizedOperation", "", nil)}, 1, true},
+		{"runs out of attempts", []error{
+			awserr.New("Throttling", "", nil), awserr.New("Throttling", "", nil), awserr.New("Throttling", "", nil),
+		}, 3, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Calls of the plan run without a report
+			shareAMI := AWSShareAMI{
+				ShareParams: &common.ShareParams{Config: config},
+				logger:      log.WithField("context", "test"),
+				mutex:       &sync.Mutex{},
+			}
+			attempts := 0
+			err := shareAMI.retryCall(context.Background(), "test", func(ctx context.Context) error {
+				attempts++
+				if attempts <= len(c.errs) {
+					return c.errs[attempts-1]
+				}
+				return nil
+			})
+			if attempts != c.attempts {
+				t.Errorf("call ran %d times, expected %d", attempts, c.attempts)
+			}
+			if (err != nil) != c.failed {
+				t.Errorf("call failed: %v, expected %v", err, c.failed)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"context"
+	"github.com/elastic/aws-ami-share/common"
+)
+
+const (
+	StepRollback = "rollback"
+)
+
+// Changes made to a target account by the apply, undone with --atomic-per-account if a step of the account fails
+type accountRollback struct {
+	failed bool
+	images []*sharedImage
+}
+
+// AMI shared with a target account by the apply, with the permissions and marker tag newly added by the apply
+type sharedImage struct {
+	action           ActionError
+	image            common.Image
+	launchPermission bool
+	snapshots        bool
+	markerTag        bool
+}
+
+// What was shared with a target account before the apply shared an AMI with it
+type sharedState struct {
+	image     bool
+	snapshots bool
+	markerTag bool
+}
+
+// What was shared with the account before the apply, by launch and create volume permissions: marker tags may be
+// missing or left over. Steps found in the journal of a resumed apply were made by an earlier apply, they are not
+// rolled back. Permissions are only described with --atomic-per-account, to know what to roll back.
+// Returns false if describing the permissions failed
+func (shareAMI *AWSShareAMI) sharedBefore(ctx context.Context, action ActionError, image common.Image, shareSnapshots bool) (sharedState, bool) {
+	before := sharedState{image: true, snapshots: true, markerTag: true}
+	if !shareAMI.ShareParams.AtomicPerAccount {
+		return before, true
+	}
+	before.markerTag = image.IsSharedWith(action.Target)
+	before.image = shareAMI.journaled(action, StepShare)
+	before.snapshots = shareAMI.journaled(action, StepShareSnapshots)
+
+	if !before.image {
+		retries, err := shareAMI.withRetries(ctx, action, StepShare, func(ctx context.Context) error {
+			permissions, err := image.LaunchPermissions(ctx)
+			for _, permission := range permissions {
+				if permission == action.TargetID {
+					before.image = true
+				}
+			}
+			return err
+		})
+		if err != nil {
+			action.Retries = retries
+			shareAMI.actionFailed(action, StepShare, err)
+			return before, false
+		}
+	}
+	if shareSnapshots && !before.snapshots {
+		retries, err := shareAMI.withRetries(ctx, action, StepShareSnapshots, func(ctx context.Context) error {
+			var err error
+			before.snapshots, err = image.SnapshotsSharedWithAccount(ctx, action.TargetID)
+			return err
+		})
+		if err != nil {
+			action.Retries = retries
+			shareAMI.actionFailed(action, StepShareSnapshots, err)
+			return before, false
+		}
+	}
+	return before, true
+}
+
+// Whether the journal records the step of the action as completed
+func (shareAMI *AWSShareAMI) journaled(action ActionError, step string) bool {
+	if shareAMI.journal == nil {
+		return false
+	}
+	_, ok := shareAMI.journal.Completed(JournalEntry{Step: step, TargetID: action.TargetID, Region: action.Region, AMI: action.AMI})
+	return ok
+}
+
+// Record an AMI shared with the account by the apply. Permissions and marker tags the account had before the apply
+// are kept on rollback
+func (shareAMI *AWSShareAMI) recordShare(action ActionError, image common.Image, launchPermission bool) *sharedImage {
+	shared := &sharedImage{action: action, image: image, launchPermission: launchPermission}
+	if !shareAMI.ShareParams.AtomicPerAccount {
+		return shared
+	}
+
+	shareAMI.mutex.Lock()
+	defer shareAMI.mutex.Unlock()
+	shareAMI.accountRollback(action.TargetID).images = append(shareAMI.accountRollback(action.TargetID).images, shared)
+	return shared
+}
+
+// Mark the account for rollback, must be called with the mutex held
+func (shareAMI *AWSShareAMI) markFailed(targetID string) {
+	if shareAMI.ShareParams.AtomicPerAccount {
+		shareAMI.accountRollback(targetID).failed = true
+	}
+}
+
+func (shareAMI *AWSShareAMI) accountRollback(targetID string) *accountRollback {
+	if shareAMI.rollbacks == nil {
+		shareAMI.rollbacks = make(map[string]*accountRollback)
+	}
+	rollback, ok := shareAMI.rollbacks[targetID]
+	if !ok {
+		rollback = &accountRollback{}
+		shareAMI.rollbacks[targetID] = rollback
+	}
+	return rollback
+}
+
+// Whether the account failed and its changes are rolled back
+func (shareAMI *AWSShareAMI) rolledBack(targetID string) bool {
+	shareAMI.mutex.Lock()
+	defer shareAMI.mutex.Unlock()
+	rollback, ok := shareAMI.rollbacks[targetID]
+	return ok && rollback.failed
+}
+
+// Tasks revoking the launch and snapshot permissions and removing the marker tags added to the failed accounts
+func (shareAMI *AWSShareAMI) rollbackTasks(ctx context.Context, plan *AMISharePlan) []applyTask {
+	var tasks []applyTask
+	for i := range plan.TargetAccounts {
+		account := &plan.TargetAccounts[i]
+		if !shareAMI.rolledBack(account.ID) {
+			continue
+		}
+		if ctx.Err() != nil {
+			shareAMI.logger.Warnf("Not rolling back account [%s]: apply interrupted", account.ID)
+			continue
+		}
+		var images []*sharedImage
+		for _, shared := range shareAMI.rollbacks[account.ID].images {
+			// AMIs the account could already use, with their snapshots and marker tag, are left as they were
+			if shared.launchPermission || shared.snapshots || shared.markerTag {
+				images = append(images, shared)
+			}
+		}
+		shareAMI.logger.Warnf("Rolling back %d AMIs shared with account [%s]: a step of the account failed", len(images), account.ID)
+		shareAMI.report.RolledBack = append(shareAMI.report.RolledBack, account.Alias)
+		for _, shared := range images {
+			shared := shared
+			tasks = append(tasks, applyTask{region: shared.action.Region, run: func() {
+				shareAMI.rollback(ctx, account, shared)
+			}})
+		}
+	}
+	return tasks
+}
+
+func (shareAMI *AWSShareAMI) rollback(ctx context.Context, account *AMISharePlanAccount, shared *sharedImage) {
+	if shareAMI.interrupted(ctx) {
+		return
+	}
+	action := shared.action
+	shareAMI.logger.Infof("Unsharing AMI %s[%s] with account [%s] in region [%s]", action.Group, action.AMI, account.ID, action.Region)
+	var retries int
+	var err error
+	if shared.launchPermission {
+		retries, err = shareAMI.withRetries(ctx, action, StepRollback, func(ctx context.Context) error {
+			return shared.image.UnshareWithAccount(ctx, account.ID, shared.snapshots)
+		})
+	} else if shared.snapshots {
+		// The account could launch the AMI before the apply, only its snapshots are unshared
+		retries, err = shareAMI.withRetries(ctx, action, StepRollback, func(ctx context.Context) error {
+			return shared.image.UnshareSnapshotsWithAccount(ctx, account.ID)
+		})
+	}
+	if err == nil && shared.markerTag {
+		var tagRetries int
+		tagRetries, err = shareAMI.withRetries(ctx, action, StepRollback, func(ctx context.Context) error {
+			return shared.image.RemoveTags(ctx, []string{ShareWithTag(account.Alias)}, shareAMI.ShareParams.ShareSnapshots)
+		})
+		retries += tagRetries
+	}
+	if err != nil {
+		action.Retries = retries
+		shareAMI.actionFailed(action, StepRollback, err)
+		return
+	}
+
+	// The next apply shares the AMI again
+	for _, step := range []string{StepShare, StepShareSnapshots, StepMarkerTags, StepCopyTags} {
+		shareAMI.recordStep(JournalEntry{Step: step, TargetID: action.TargetID, Region: action.Region, AMI: action.AMI, Undone: true})
+	}
+}
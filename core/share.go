@@ -18,12 +18,16 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/elastic/aws-ami-share/common"
 	"github.com/elastic/aws-ami-share/utils"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
 )
 
 const (
@@ -34,48 +38,76 @@ const (
 type ImagesByRegion map[string]common.Images
 type ImagesByGroup map[string]ImagesByRegion
 
-type AMISharePlanAccount struct {
-	ID         string        `yaml:"id"`
-	Alias      string        `yaml:"alias"`
-	AssumeRole string        `yaml:"assume-role"`
-	AMIs       ImagesByGroup `yaml:"amis"`
-}
-
-type AMISharePlan struct {
-	SourceAccount  AMISharePlanAccount   `yaml:"source-account"`
-	TargetAccounts []AMISharePlanAccount `yaml:"target-accounts"`
-}
+// Shares an image with an organization ARN or organizational unit ARN
+type organizationShareFunc func(image common.Image, ctx context.Context, arn string, shareSnapshots bool) error
 
 type AWSShareAMI struct {
 	ShareParams    *common.ShareParams
 	logger         *log.Entry
 	sessionFactory *utils.AWSSessionFactory
+	// replicas of source AMIs by region and source AMI ID
+	replicas map[string]common.Image
+	// closed once the replication of a source AMI into a region is done, by region and source AMI ID
+	replicated map[string]chan struct{}
+	// report of the running apply
+	report *RunReport
+	// completed steps of the apply, if journaled
+	journal *Journal
+	// changes of the apply by target account, with --atomic-per-account
+	rollbacks map[string]*accountRollback
+	// scanned AMIs by account ID and region
+	scans map[string]common.Images
+	// guards the state updated by concurrent scans and by the tasks of an apply
+	mutex *sync.Mutex
 }
 
 func NewAWSShareAMI(params *common.ShareParams) (AWSShareAMI, error) {
 	shareAMI := AWSShareAMI{
 		ShareParams: params,
+		scans:       make(map[string]common.Images),
+		mutex:       &sync.Mutex{},
 		logger: log.WithFields(log.Fields{
 			"context":   "aws-share-ami",
 			"operation": "share",
 		}),
 	}
 	sessionFactory := utils.NewAWSSessionFactory()
+	sessionFactory.MFATokens = utils.NewMFATokenProvider(params.MFAToken)
 	shareAMI.sessionFactory = sessionFactory
 	_, err := sessionFactory.GenerateMasterSession(AccountSessionKey(&params.Config.SourceAccount, DefaultRegion))
 	return shareAMI, err
 }
 
-func (shareAMI *AWSShareAMI) ValidateAccounts() error {
+// Check that the credentials of the accounts with a credential source can be retrieved
+func (shareAMI *AWSShareAMI) ValidateCredentialSources(ctx context.Context) error {
+	config := shareAMI.ShareParams.Config
+	for _, account := range append([]common.Account{config.SourceAccount}, config.TargetAccounts...) {
+		source := AccountSessionKey(&account, DefaultRegion).Source
+		if source == (utils.CredentialSource{}) {
+			continue
+		}
+		shareAMI.logger.Infof("Validating credential source of account: %v", account.ID)
+		if err := shareAMI.sessionFactory.ValidateCredentialSource(ctx, source); err != nil {
+			return errors.New(fmt.Sprintf("invalid credentials on [%s]: %v", account.Alias, err))
+		}
+	}
+	return nil
+}
+
+func (shareAMI *AWSShareAMI) ValidateAccounts(ctx context.Context) error {
 	shareAMI.logger.Infof("Validating source account")
-	err := ValidateAccount(shareAMI.sessionFactory, &shareAMI.ShareParams.Config.SourceAccount)
+	err := shareAMI.retryCall(ctx, "validating source account", func(ctx context.Context) error {
+		return ValidateAccount(ctx, shareAMI.sessionFactory, &shareAMI.ShareParams.Config.SourceAccount)
+	})
 	if err != nil {
 		return err
 	}
 
 	for _, account := range shareAMI.ShareParams.Config.TargetAccounts {
 		shareAMI.logger.Infof("Validating account: %v", account.ID)
-		err := ValidateAccount(shareAMI.sessionFactory, &account)
+		err := shareAMI.retryCall(ctx, fmt.Sprintf("validating account %s", account.ID), func(ctx context.Context) error {
+			return ValidateAccount(ctx, shareAMI.sessionFactory, &account)
+		})
 		if err != nil {
 			return err
 		}
@@ -83,28 +115,97 @@ func (shareAMI *AWSShareAMI) ValidateAccounts() error {
 	return nil
 }
 
-func (shareAMI *AWSShareAMI) ScanForAMIs(account *common.Account) (ImagesByRegion, error) {
-	regionImages := make(ImagesByRegion)
-	config := shareAMI.ShareParams.Config
-	for _, region := range config.ScanRegions() {
-		sess, err := shareAMI.sessionFactory.GetSession(AccountSessionKey(account, region))
+// Check that the KMS keys for encrypting copies exist in every region the copies are made in,
+// and that the KMS keys for encrypting replicas exist in their region
+func (shareAMI *AWSShareAMI) ValidateKMSKeys(ctx context.Context) error {
+	sourceAccount := &shareAMI.ShareParams.Config.SourceAccount
+	for region, kmsKeyId := range sourceAccount.ReplicaKMSKeys {
+		shareAMI.logger.Infof("Validating replica KMS key %s of source account in [%s]", kmsKeyId, region)
+		err := shareAMI.retryCall(ctx, fmt.Sprintf("validating KMS key %s", kmsKeyId), func(ctx context.Context) error {
+			return ValidateKMSKey(ctx, shareAMI.sessionFactory, sourceAccount, region, kmsKeyId)
+		})
 		if err != nil {
-			return regionImages, err
+			return err
 		}
+	}
+	for _, account := range shareAMI.ShareParams.Config.TargetAccounts {
+		for group := range account.AMIs {
+			kmsKeyId := account.CopyKMSKeyID(group)
+			if kmsKeyId == "" {
+				continue
+			}
+			for _, region := range account.SelectionRegions(group) {
+				shareAMI.logger.Infof("Validating KMS key %s of account %v in [%s]", kmsKeyId, account.ID, region)
+				err := shareAMI.retryCall(ctx, fmt.Sprintf("validating KMS key %s", kmsKeyId), func(ctx context.Context) error {
+					return ValidateKMSKey(ctx, shareAMI.sessionFactory, &account, region, kmsKeyId)
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Scan the AMIs of the account in the regions needed by the selections of the config, all regions at once
+func (shareAMI *AWSShareAMI) ScanForAMIs(ctx context.Context, account *common.Account) (ImagesByRegion, error) {
+	regions := shareAMI.ShareParams.Config.ScanRegions()
+	started := time.Now()
+	images := make([]common.Images, len(regions))
+	errs := make([]error, len(regions))
+	var scans sync.WaitGroup
+	for i, region := range regions {
+		scans.Add(1)
+		go func(i int, region string) {
+			defer scans.Done()
+			images[i], errs[i] = shareAMI.scanRegion(ctx, account, region)
+		}(i, region)
+	}
+	scans.Wait()
 
-		if images, err := ListAMIs(sess); err != nil {
-			return regionImages, err
-		} else {
-			regionImages[region] = images
+	regionImages := make(ImagesByRegion)
+	for i, region := range regions {
+		if errs[i] != nil {
+			return regionImages, errs[i]
 		}
+		regionImages[region] = images[i]
 	}
+	shareAMI.logger.Infof("Scanned %d regions of account [%s] in %s", len(regions), account.ID, time.Since(started).Round(time.Millisecond))
 	return regionImages, nil
 }
 
-func (shareAMI *AWSShareAMI) FilterAMIs(sourceImages ImagesByRegion, account common.Account) (ImagesByGroup, error) {
+// AMIs of the account in the region. Scans are cached by account and region, so a region is scanned once per account
+func (shareAMI *AWSShareAMI) scanRegion(ctx context.Context, account *common.Account, region string) (common.Images, error) {
+	key := fmt.Sprintf("%s/%s", account.ID, region)
+	shareAMI.mutex.Lock()
+	images, ok := shareAMI.scans[key]
+	shareAMI.mutex.Unlock()
+	if ok {
+		shareAMI.logger.Debugf("Using scanned AMIs of account [%s] in [%s]", account.ID, region)
+		return images, nil
+	}
+
+	sess, err := shareAMI.sessionFactory.GetSession(ctx, AccountSessionKey(account, region))
+	if err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	images, err = ListAMIs(ctx, sess, shareAMI.retryCall)
+	if err != nil {
+		return nil, err
+	}
+	shareAMI.logger.Infof("Scanned %d AMIs of account [%s] in [%s] in %s", len(images), account.ID, region, time.Since(started).Round(time.Millisecond))
+
+	shareAMI.mutex.Lock()
+	shareAMI.scans[key] = images
+	shareAMI.mutex.Unlock()
+	return images, nil
+}
+
+func (shareAMI *AWSShareAMI) FilterAMIs(sourceImages ImagesByRegion, accountRegions []string, selections map[string]common.AMISelection) (ImagesByGroup, error) {
 	groupedImages := make(ImagesByGroup)
-	accountRegions := account.Regions
-	for group, ami := range account.AMIs {
+	for group, ami := range selections {
 		shareAMI.logger.Infof("Processing %s AMIs", group)
 		groupRegions := ami.Regions
 		if len(groupRegions) < 1 {
@@ -113,7 +214,15 @@ func (shareAMI *AWSShareAMI) FilterAMIs(sourceImages ImagesByRegion, account com
 
 		regionImages := make(ImagesByRegion)
 		for _, region := range groupRegions {
-			filteredImages := common.ApplyFilters(sourceImages[region], ami.Filters)
+			var filteredImages common.Images
+			if ami.SourceRegion == "" {
+				filteredImages = common.ApplyFilters(sourceImages[region], ami.Filters)
+			} else {
+				filteredImages = common.ApplyFilters(sourceImages[region], withoutReplicas(ami.Filters))
+				if len(filteredImages) < 1 && region != ami.SourceRegion {
+					filteredImages = replicaImages(sourceImages, ami, region)
+				}
+			}
 			shareAMI.logger.Debugf("Filters for %s: [%v] AMIs in [%s]", group, ami.Filters, region)
 			shareAMI.logger.Infof("Found %v %s AMIs in [%s]", len(filteredImages), group, region)
 			shareAMI.logger.Debugf("Filtered %s AMIs in [%s] => %s", group, region, filteredImages)
@@ -126,95 +235,801 @@ func (shareAMI *AWSShareAMI) FilterAMIs(sourceImages ImagesByRegion, account com
 	return groupedImages, nil
 }
 
-func (shareAMI *AWSShareAMI) Run() error {
+// Replicas are excluded from filters: a replica of an older source AMI must not hide the latest source AMI
+func withoutReplicas(filters []common.Filter) []common.Filter {
+	var result []common.Filter
+	result = append(result, filters...)
+	return append(result, common.Filter{Property: fmt.Sprintf("tag:%s", LineageTag), Value: ""})
+}
+
+// Latest AMI in the source region of the selection, or its existing replica in the given region.
+// If the AMI was not replicated yet, the source AMI is returned and has to be replicated before sharing
+func replicaImages(sourceImages ImagesByRegion, selection common.AMISelection, region string) common.Images {
+	latest := common.ApplyFilters(sourceImages[selection.SourceRegion], withoutReplicas(selection.Filters))
+	if len(latest) < 1 {
+		return latest
+	}
+	for _, image := range sourceImages[region] {
+		if image.Properties().Get(fmt.Sprintf("tag:%s", LineageTag)) == latest[0].String() {
+			return common.Images{image}
+		}
+	}
+	return latest
+}
+
+func (shareAMI *AWSShareAMI) Run(ctx context.Context) (*AMISharePlan, error) {
+	plan, err := shareAMI.Plan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := shareAMI.WritePlan(plan); err != nil {
+		return plan, err
+	}
+	if err := shareAMI.PrintSummary(plan); err != nil {
+		return plan, err
+	}
+
+	if shareAMI.ShareParams.NoDryRun {
+		return plan, shareAMI.Apply(ctx, plan)
+	}
+	shareAMI.logger.Infof("Would share AMIs in plan: %v", shareAMI.ShareParams.PlanFile)
+	return plan, nil
+}
+
+func (shareAMI *AWSShareAMI) Plan(ctx context.Context) (*AMISharePlan, error) {
 	shareAMI.logger.Infof("Generating plan for sharing AMIs")
 	plan := new(AMISharePlan)
+	now := time.Now()
 	config := shareAMI.ShareParams.Config
-	imagesByRegion, err := shareAMI.ScanForAMIs(&config.SourceAccount)
+	imagesByRegion, err := shareAMI.ScanForAMIs(ctx, &config.SourceAccount)
 	if err != nil {
-		return err
+		return plan, err
 	}
 	shareAMI.logger.Debugf("AMIs in source account: %v", imagesByRegion)
 
+	// Launch permissions of the filtered AMIs, described once for all targets
+	launchPermissions := make(map[string][]string)
+	plan.ConfigHash = config.Hash()
 	plan.SourceAccount = AMISharePlanAccount{
 		ID:         config.SourceAccount.ID,
 		Alias:      config.SourceAccount.Alias,
-		AssumeRole: config.SourceAccount.AssumeRole,
+		AssumeRole: config.SourceAccount.AssumeRole.Role(),
 		AMIs:       ImagesByGroup{All: imagesByRegion},
 	}
 
 	for _, account := range config.TargetAccounts {
-		imagesToShare, _ := shareAMI.FilterAMIs(imagesByRegion, account)
+		imagesToShare, _ := shareAMI.FilterAMIs(imagesByRegion, account.Regions, account.AMIs)
 		shareAMI.logger.Infof("Account: %v", imagesToShare)
+		kmsActions, err := shareAMI.PlanKMSActions(ctx, imagesToShare, account)
+		if err != nil {
+			return plan, err
+		}
+		copies := PlanCopies(imagesToShare, account)
+		if err := shareAMI.FindCopies(ctx, &account, copies); err != nil {
+			return plan, err
+		}
+		shared, err := sharedImages(ctx, imagesToShare, account.ID, launchPermissions, shareAMI.retryCall)
+		if err != nil {
+			return plan, err
+		}
 		plan.TargetAccounts = append(plan.TargetAccounts, AMISharePlanAccount{
-			ID:         account.ID,
-			Alias:      account.Alias,
-			AssumeRole: account.AssumeRole,
-			AMIs:       imagesToShare,
+			ID:               account.ID,
+			Alias:            account.Alias,
+			AssumeRole:       account.AssumeRole.Role(),
+			AMIs:             imagesToShare,
+			Copies:           copies,
+			KMSActions:       kmsActions,
+			RetentionActions: PlanUnshares(imagesByRegion, account, imagesToShare, now),
+			Shared:           shared,
+		})
+	}
+
+	for _, organization := range config.TargetOrganizations {
+		imagesToShare, _ := shareAMI.FilterAMIs(imagesByRegion, organization.Regions, organization.AMIs)
+		shareAMI.logger.Infof("Organization: %v", imagesToShare)
+		shared, err := sharedImages(ctx, imagesToShare, organization.ARN, launchPermissions, shareAMI.retryCall)
+		if err != nil {
+			return plan, err
+		}
+		plan.TargetOrganizations = append(plan.TargetOrganizations, AMISharePlanOrganization{
+			ARN:    organization.ARN,
+			Alias:  organization.Alias,
+			AMIs:   imagesToShare,
+			Shared: shared,
 		})
 	}
+
+	for _, organizationalUnit := range config.TargetOrganizationalUnits {
+		imagesToShare, _ := shareAMI.FilterAMIs(imagesByRegion, organizationalUnit.Regions, organizationalUnit.AMIs)
+		shareAMI.logger.Infof("Organizational unit: %v", imagesToShare)
+		shared, err := sharedImages(ctx, imagesToShare, organizationalUnit.ARN, launchPermissions, shareAMI.retryCall)
+		if err != nil {
+			return plan, err
+		}
+		plan.TargetOrganizationalUnits = append(plan.TargetOrganizationalUnits, AMISharePlanOrganization{
+			ARN:    organizationalUnit.ARN,
+			Alias:  organizationalUnit.Alias,
+			AMIs:   imagesToShare,
+			Shared: shared,
+		})
+	}
+	plan.Replications, err = PlanReplications(plan, config.SourceAccount.ReplicaKMSKeys)
+	if err != nil {
+		return plan, err
+	}
+	plan.SourceAccount.RetentionActions = PlanDeregistrations(imagesByRegion, plan, config, now)
 	shareAMI.logger.Debugf("Plan for sharing: %v", plan)
-	if err := shareAMI.WritePlan(plan); err != nil {
+	return plan, nil
+}
+
+// IDs of the filtered AMIs already shared with the principal (account ID, organization or organizational unit ARN)
+// of a target, by launch permission: the marker tags may be missing, e.g. for AMIs shared by hand.
+// Launch permissions are cached by AMI ID. AMIs not replicated yet are not shared
+func sharedImages(ctx context.Context, imagesToShare ImagesByGroup, principal string, launchPermissions map[string][]string, retry Retry) (map[string]bool, error) {
+	shared := make(map[string]bool)
+	for _, imagesByRegion := range imagesToShare {
+		for region, images := range imagesByRegion {
+			for _, image := range images {
+				if image.Region() != region {
+					continue
+				}
+				permissions, ok := launchPermissions[image.String()]
+				if !ok {
+					err := retry(ctx, fmt.Sprintf("describing launch permissions of AMI [%s]", image.String()), func(ctx context.Context) (err error) {
+						permissions, err = image.LaunchPermissions(ctx)
+						return err
+					})
+					if err != nil {
+						return nil, err
+					}
+					launchPermissions[image.String()] = permissions
+				}
+				for _, permission := range permissions {
+					if permission == principal {
+						shared[image.String()] = true
+					}
+				}
+			}
+		}
+	}
+	return shared, nil
+}
+
+// Run the actions of a plan. AMIs of the source account are looked up in the plan,
+// so a plan loaded from a file is applied without scanning the source account again.
+// Once ctx is canceled, running steps finish and the remaining steps are skipped
+func (shareAMI *AWSShareAMI) Apply(ctx context.Context, plan *AMISharePlan) error {
+	shareAMI.logger.Infof("Running plan for sharing AMIs")
+	shareAMI.report = newRunReport()
+	shareAMI.rollbacks = nil
+	if journalFile := shareAMI.ShareParams.JournalFile; journalFile != "" {
+		journal, err := OpenJournal(journalFile, shareAMI.ShareParams.Resume)
+		if err != nil {
+			return err
+		}
+		defer journal.Close()
+		shareAMI.journal = journal
+		if shareAMI.ShareParams.Resume {
+			shareAMI.logger.Infof("Resuming from journal %s: skipping %d completed steps", journalFile, journal.Len())
+		}
+	}
+	imagesByRegion := plan.SourceAccount.AMIs[All]
+	// Replications and KMS actions run first in the pool. A share task waits for the KMS actions and for the replicas
+	// of its region only, so shares start while AMIs are replicated into other regions
+	tasks := shareAMI.replicationTasks(ctx, plan, imagesByRegion)
+	kmsTasks := shareAMI.kmsTasks(ctx, plan)
+	var kmsDone sync.WaitGroup
+	kmsDone.Add(len(kmsTasks))
+	for i := range kmsTasks {
+		run := kmsTasks[i].run
+		kmsTasks[i].run = func() {
+			defer kmsDone.Done()
+			run()
+		}
+	}
+	tasks = append(tasks, kmsTasks...)
+
+	var shareTasks, unshareTasks []applyTask
+	for i := range plan.TargetAccounts {
+		account := &plan.TargetAccounts[i]
+		for _, region := range planRegions(account.AMIs) {
+			region := region
+			shareTasks = append(shareTasks, applyTask{region: region, run: func() {
+				shareAMI.ShareWithAccount(ctx, account, region)
+			}, wait: func() {
+				kmsDone.Wait()
+				shareAMI.waitReplicas(account.AMIs, region)
+			}})
+		}
+		for _, action := range account.RetentionActions {
+			action := action
+			unshareTasks = append(unshareTasks, applyTask{region: action.Region, run: func() {
+				// Older AMIs stay shared with rolled back accounts
+				if !shareAMI.rolledBack(account.ID) {
+					shareAMI.ApplyUnshare(ctx, account, action, imagesByRegion)
+				}
+			}})
+		}
+	}
+	for _, organization := range plan.TargetOrganizations {
+		shareTasks = append(shareTasks, shareAMI.organizationTasks(ctx, organization, common.Image.ShareWithOrganization)...)
+	}
+	for _, organizationalUnit := range plan.TargetOrganizationalUnits {
+		shareTasks = append(shareTasks, shareAMI.organizationTasks(ctx, organizationalUnit, common.Image.ShareWithOrganizationalUnit)...)
+	}
+	shareAMI.runTasks(append(tasks, shareTasks...))
+	shareAMI.runTasks(shareAMI.rollbackTasks(ctx, plan))
+	shareAMI.runTasks(unshareTasks)
+
+	var deregisterTasks []applyTask
+	for _, action := range plan.SourceAccount.RetentionActions {
+		action := action
+		deregisterTasks = append(deregisterTasks, applyTask{region: action.Region, run: func() {
+			shareAMI.ApplyDeregistration(ctx, &plan.SourceAccount, action, imagesByRegion)
+		}})
+	}
+	shareAMI.runTasks(deregisterTasks)
+	return shareAMI.finishReport(ctx)
+}
+
+// Regions of the AMIs of a target, sorted
+func planRegions(imagesByGroup ImagesByGroup) []string {
+	var regions []string
+	seen := make(map[string]bool)
+	for _, imagesByRegion := range imagesByGroup {
+		for region := range imagesByRegion {
+			if !seen[region] {
+				seen[region] = true
+				regions = append(regions, region)
+			}
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// One task per KMS key, running the actions of all accounts on the key in turn: adding a statement
+// reads, modifies and writes the key policy, concurrent writes would overwrite each other
+func (shareAMI *AWSShareAMI) kmsTasks(ctx context.Context, plan *AMISharePlan) []applyTask {
+	var keys []string
+	actionsByKey := make(map[string][]func())
+	regions := make(map[string]string)
+	for i := range plan.TargetAccounts {
+		account := &plan.TargetAccounts[i]
+		for _, kmsAction := range account.KMSActions {
+			kmsAction := kmsAction
+			// Key ARNs include the region of the key
+			if _, ok := actionsByKey[kmsAction.KeyARN]; !ok {
+				keys = append(keys, kmsAction.KeyARN)
+				regions[kmsAction.KeyARN] = kmsAction.Region
+			}
+			actionsByKey[kmsAction.KeyARN] = append(actionsByKey[kmsAction.KeyARN], func() {
+				shareAMI.ApplyKMSAction(ctx, account, kmsAction)
+			})
+		}
+	}
+
+	var tasks []applyTask
+	for _, key := range keys {
+		actions := actionsByKey[key]
+		tasks = append(tasks, applyTask{region: regions[key], run: func() {
+			for _, action := range actions {
+				action()
+			}
+		}})
+	}
+	return tasks
+}
+
+func (shareAMI *AWSShareAMI) organizationTasks(ctx context.Context, organization AMISharePlanOrganization, share organizationShareFunc) []applyTask {
+	var tasks []applyTask
+	for _, region := range planRegions(organization.AMIs) {
+		region := region
+		tasks = append(tasks, applyTask{region: region, run: func() {
+			shareAMI.ShareWithOrganization(ctx, organization, region, share)
+		}, wait: func() {
+			shareAMI.waitReplicas(organization.AMIs, region)
+		}})
+	}
+	return tasks
+}
+
+// Run a KMS action giving the target account access to a key of the source account
+func (shareAMI *AWSShareAMI) ApplyKMSAction(ctx context.Context, account *AMISharePlanAccount, kmsAction KMSAction) {
+	if kmsAction.Action != KMSActionCreateGrant && kmsAction.Action != KMSActionAddStatement {
+		return
+	}
+	shareAMI.logger.Infof("Running KMS action %s on key [%s] for account [%s]", kmsAction.Action, kmsAction.KeyARN, account.ID)
+	// KMS actions are journaled by key, grants are not idempotent
+	action := ActionError{Target: account.Alias, TargetID: account.ID, Region: kmsAction.Region, AMI: kmsAction.KeyARN}
+	shareAMI.runStep(ctx, action, StepKMSAction, func(ctx context.Context) error {
+		err := ApplyKMSAction(ctx, shareAMI.sessionFactory, &shareAMI.ShareParams.Config.SourceAccount, kmsAction, account.ID, account.Alias)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s on key [%s]: %v", kmsAction.Action, kmsAction.KeyARN, err))
+		}
 		return nil
+	})
+}
+
+// Share the AMIs of all groups in a region with the account
+func (shareAMI *AWSShareAMI) ShareWithAccount(ctx context.Context, account *AMISharePlanAccount, region string) {
+	config := shareAMI.ShareParams.Config
+	for amiGroup, amisByRegion := range account.AMIs {
+		for _, ami := range amisByRegion[region] {
+			shareAMI.logger.Infof("Sharing AMI %s[%s] with account [%s] in region [%s]", amiGroup, ami.String(), account.ID, region)
+			action := ActionError{Target: account.Alias, TargetID: account.ID, Region: region, Group: amiGroup, AMI: ami.String()}
+			// Copying a shared AMI requires access to its snapshots
+			amiCopy := account.FindCopy(amiGroup, region, ami.String())
+			shareSnapshots := shareAMI.ShareParams.ShareSnapshots || amiCopy != nil
+			ami, err := shareAMI.RegionalImage(ami, region)
+			if err != nil {
+				shareAMI.actionFailed(action, StepFindImage, err)
+				continue
+			}
+			before, ok := shareAMI.sharedBefore(ctx, action, ami, shareSnapshots)
+			if !ok {
+				continue
+			}
+			if !shareAMI.runStep(ctx, action, StepShare, func(ctx context.Context) error { return ami.ShareWithAccount(ctx, account.ID, false) }) {
+				continue
+			}
+			shared := shareAMI.recordShare(action, ami, !before.image)
+			if shareSnapshots {
+				// Snapshots are unshared on rollback even if sharing them failed half way
+				shared.snapshots = !before.snapshots
+				if !shareAMI.runStep(ctx, action, StepShareSnapshots, func(ctx context.Context) error { return ami.ShareSnapshotsWithAccount(ctx, account.ID) }) {
+					continue
+				}
+			}
+			shareMetaTags := map[string]string{ShareWithTag(account.Alias): "1"}
+			markerTag := shareAMI.runStep(ctx, action, StepMarkerTags, func(ctx context.Context) error {
+				return ami.AddTags(ctx, shareMetaTags, shareAMI.ShareParams.ShareSnapshots)
+			})
+			shared.markerTag = markerTag && !before.markerTag
+
+			if len(config.SourceAccount.PostShareTags) > 0 {
+				shareAMI.runStep(ctx, action, StepPostShareTags, func(ctx context.Context) error { return ami.AddTags(ctx, config.SourceAccount.PostShareTags, true) })
+			}
+
+			sess, err := shareAMI.sessionFactory.GetSession(ctx, shareAMI.targetSessionKey(account, region))
+			if err != nil {
+				shareAMI.actionFailed(action, StepSession, err)
+				continue
+			}
+
+			if !shareAMI.runStep(ctx, action, StepCopyTags, func(ctx context.Context) error { return ami.CopyTags(ctx, sess, shareAMI.ShareParams.ShareSnapshots) }) {
+				continue
+			}
+
+			// Copies found when planning were made by a previous apply
+			if amiCopy != nil && amiCopy.ID == "" {
+				shareAMI.copyToAccount(ctx, action, ami, *amiCopy, sess)
+			}
+		}
 	}
+}
 
-	if shareAMI.ShareParams.NoDryRun {
-		shareAMI.logger.Infof("Running plan for sharing AMIs")
-		// Iterate over all target accounts by region
-		// For a given region share each the AMIs that were previously filtered in plan
-		// Copy over tags for each AMI and mark AMI as shared usign post-sharing tags
-		for _, account := range plan.TargetAccounts {
-			for amiGroup, amisByRegion := range account.AMIs {
-				for region, amis := range amisByRegion {
-					for _, ami := range amis {
-						shareAMI.logger.Infof("Sharing AMI %s[%s] with account [%s] in region [%s]", amiGroup, ami.String(), account.ID, region)
-						err := ami.ShareWithAccount(account.ID, shareAMI.ShareParams.ShareSnapshots)
-						if err != nil {
-							shareAMI.logger.Errorf("Failed to share AMI [%s] with account: %s. Error: %s", ami.String(), account.ID, err)
-							break
-						}
-						shareMetaTags := map[string]string{fmt.Sprintf("%s-%s", ShareWithPrefix, account.Alias): "1"}
-						err = ami.AddTags(shareMetaTags, shareAMI.ShareParams.ShareSnapshots)
-						if err != nil {
-							shareAMI.logger.Errorf("Failed to add meta post-share tags to AMI [%s] in account: [%s]. Error: %s", ami.String(), account.ID, err)
-						}
-
-						if len(config.SourceAccount.PostShareTags) > 0 {
-							err = ami.AddTags(config.SourceAccount.PostShareTags, true)
-							if err != nil {
-								shareAMI.logger.Errorf("Failed to add post-share tags to AMI [%s] in account: [%s]. Error: %s", ami.String(), account.ID, err)
-							}
-						}
-
-						sess, err := shareAMI.sessionFactory.GetSession(utils.SessionKey{AccountID: account.ID, AssumeRole: account.AssumeRole, Region: region})
-						if err != nil {
-							shareAMI.logger.Errorf("Failed to get session for account: %s in region [%s]. Error: %s", account.ID, region, err)
-							break
-						}
-
-						err = ami.CopyTags(sess, shareAMI.ShareParams.ShareSnapshots)
-						if err != nil {
-							shareAMI.logger.Errorf("Failed to copy tags for AMI [%s] in account: %s. Error: %s", ami.String(), account.ID, err)
-							break
-						}
+// Copy the AMI into the target account, unless the journal records the copy. The ID of the copy is recorded
+// in the journal and in the run report
+func (shareAMI *AWSShareAMI) copyToAccount(ctx context.Context, action ActionError, ami common.Image, amiCopy AMICopy, sess *session.Session) {
+	step := JournalEntry{Step: StepCopy, TargetID: action.TargetID, Region: action.Region, AMI: action.AMI}
+	if shareAMI.journal != nil {
+		if entry, ok := shareAMI.journal.Completed(step); ok {
+			amiCopy.ID = entry.ID
+			shareAMI.reportCopy(action.TargetID, amiCopy)
+			return
+		}
+	}
+	if shareAMI.interrupted(ctx) {
+		return
+	}
+
+	shareAMI.logger.Infof("Copying AMI %s[%s] into account [%s] in region [%s]", action.Group, action.AMI, action.TargetID, action.Region)
+	started := JournalEntry{Step: StepStartCopy, TargetID: action.TargetID, Region: action.Region, AMI: action.AMI}
+	id, retries, err := shareAMI.runCopy(ctx, action, StepCopy, started,
+		func(ctx context.Context, clientToken string) (string, error) {
+			return ami.CopyToAccount(ctx, sess, amiCopy.KMSKeyID, clientToken)
+		},
+		func(ctx context.Context, id string) error {
+			return ami.CompleteCopy(ctx, sess, id)
+		})
+	if err == errStepInterrupted {
+		return
+	}
+	if err != nil {
+		action.Retries = retries
+		shareAMI.actionFailed(action, StepCopy, err)
+		return
+	}
+	amiCopy.ID = id
+	step.ID = id
+	shareAMI.recordStep(step)
+	shareAMI.reportCopy(action.TargetID, amiCopy)
+}
+
+// Source AMIs planned in another region than their own have to be replicated into that region,
+// encrypted AMIs with the replica KMS key of the region
+func PlanReplications(plan *AMISharePlan, replicaKMSKeys map[string]string) ([]AMIReplication, error) {
+	var replications []AMIReplication
+	planned := make(map[string]struct{})
+	var groups []ImagesByGroup
+	for _, account := range plan.TargetAccounts {
+		groups = append(groups, account.AMIs)
+	}
+	for _, organization := range append(plan.TargetOrganizations, plan.TargetOrganizationalUnits...) {
+		groups = append(groups, organization.AMIs)
+	}
+
+	for _, imagesByGroup := range groups {
+		for _, imagesByRegion := range imagesByGroup {
+			for region, images := range imagesByRegion {
+				for _, image := range images {
+					if image.Region() == region {
+						continue
+					}
+					if _, ok := planned[replicaKey(region, image.String())]; ok {
+						continue
+					}
+					planned[replicaKey(region, image.String())] = struct{}{}
+					kmsKeyId, err := replicaKMSKey(image, region, replicaKMSKeys)
+					if err != nil {
+						return nil, err
 					}
+					replications = append(replications, AMIReplication{
+						SourceRegion: image.Region(),
+						SourceID:     image.String(),
+						Region:       region,
+						KMSKeyID:     kmsKeyId,
+					})
 				}
 			}
 		}
-	} else {
-		shareAMI.logger.Infof("Would share AMIs in plan: %v", shareAMI.ShareParams.PlanFile)
 	}
+	sort.Slice(replications, func(i, j int) bool {
+		return replicaKey(replications[i].Region, replications[i].SourceID) <
+			replicaKey(replications[j].Region, replications[j].SourceID)
+	})
+	return replications, nil
+}
 
-	return nil
+// KMS key encrypting the replica of the image in the region, if the image is encrypted. Without a key,
+// the replica would be encrypted with the AWS managed key of the region, which cannot be used by other accounts
+func replicaKMSKey(image common.Image, region string, replicaKMSKeys map[string]string) (string, error) {
+	encrypted := false
+	for _, snapshot := range image.Describe().Snapshots {
+		encrypted = encrypted || snapshot.Encrypted
+	}
+	if !encrypted {
+		return "", nil
+	}
+	kmsKeyId := replicaKMSKeys[region]
+	if kmsKeyId == "" {
+		return "", &ValidationError{Err: errors.New(fmt.Sprintf("encrypted AMI [%s] cannot be replicated into [%s]: no key for the region in replica-kms-keys of the source account", image.String(), region))}
+	}
+	return kmsKeyId, nil
+}
+
+// One task per replication of the source AMIs of the plan into the regions they are shared in, keyed by the region
+// of the replica. The IDs of the replicas are recorded in the journal and in the run report
+func (shareAMI *AWSShareAMI) replicationTasks(ctx context.Context, plan *AMISharePlan, imagesByRegion ImagesByRegion) []applyTask {
+	shareAMI.replicas = make(map[string]common.Image)
+	shareAMI.replicated = make(map[string]chan struct{})
+	var tasks []applyTask
+	for _, replication := range plan.Replications {
+		replication := replication
+		done := make(chan struct{})
+		shareAMI.replicated[replicaKey(replication.Region, replication.SourceID)] = done
+		tasks = append(tasks, applyTask{region: replication.Region, run: func() {
+			defer close(done)
+			shareAMI.replicate(ctx, replication, imagesByRegion)
+		}})
+	}
+	return tasks
 }
 
-func (shareAMI *AWSShareAMI) WritePlan(plan *AMISharePlan) error {
-	raw, err := yaml.Marshal(plan)
+func (shareAMI *AWSShareAMI) replicate(ctx context.Context, replication AMIReplication, imagesByRegion ImagesByRegion) {
+	sourceAccount := &shareAMI.ShareParams.Config.SourceAccount
+	action := ActionError{Target: sourceAccount.Alias, TargetID: sourceAccount.ID, Region: replication.Region, AMI: replication.SourceID}
+	source := common.FindImage(imagesByRegion[replication.SourceRegion], replication.SourceID)
+	if source == nil {
+		shareAMI.actionFailed(action, StepFindImage, errors.New(fmt.Sprintf("source AMI not found in [%s]", replication.SourceRegion)))
+		return
+	}
+
+	sess, err := shareAMI.sessionFactory.GetSession(ctx, AccountSessionKey(sourceAccount, replication.Region))
 	if err != nil {
-		return err
+		shareAMI.actionFailed(action, StepSession, err)
+		return
 	}
+	step := JournalEntry{Step: StepReplicate, TargetID: action.TargetID, Region: action.Region, AMI: action.AMI}
+	if shareAMI.journal != nil {
+		if entry, ok := shareAMI.journal.Completed(step); ok {
+			replica, err := shareAMI.loadReplica(ctx, sess, entry.ID)
+			if err != nil {
+				shareAMI.actionFailed(action, StepReplicate, err)
+				return
+			}
+			shareAMI.recordReplica(replication, replica)
+			return
+		}
+	}
+	if shareAMI.interrupted(ctx) {
+		return
+	}
+
+	shareAMI.logger.Infof("Replicating AMI [%s] from region [%s] into region [%s]", replication.SourceID, replication.SourceRegion, replication.Region)
+	started := JournalEntry{Step: StepStartReplicate, TargetID: action.TargetID, Region: action.Region, AMI: action.AMI}
+	id, retries, err := shareAMI.runCopy(ctx, action, StepReplicate, started,
+		func(ctx context.Context, clientToken string) (string, error) {
+			return source.Replicate(ctx, sess, replication.KMSKeyID, clientToken)
+		},
+		func(ctx context.Context, id string) error {
+			return source.CompleteCopy(ctx, sess, id)
+		})
+	if err == errStepInterrupted {
+		return
+	}
+	if err != nil {
+		action.Retries = retries
+		shareAMI.actionFailed(action, StepReplicate, err)
+		return
+	}
+	replica, err := shareAMI.loadReplica(ctx, sess, id)
+	if err != nil {
+		shareAMI.actionFailed(action, StepReplicate, err)
+		return
+	}
+	shareAMI.recordReplica(replication, replica)
+	step.ID = replica.String()
+	shareAMI.recordStep(step)
+}
+
+// Record a replica for the shares of its region, and in the report
+func (shareAMI *AWSShareAMI) recordReplica(replication AMIReplication, replica common.Image) {
+	shareAMI.mutex.Lock()
+	defer shareAMI.mutex.Unlock()
+	replication.ID = replica.String()
+	shareAMI.replicas[replicaKey(replication.Region, replication.SourceID)] = replica
+	shareAMI.report.Replications = append(shareAMI.report.Replications, replication)
+}
 
-	err = ioutil.WriteFile(shareAMI.ShareParams.PlanFile, raw, 0644)
-	shareAMI.logger.Infof("Wrote plan to: %s", shareAMI.ShareParams.PlanFile)
+// Wait for the replications of the AMIs shared in the region, whether they succeed or fail
+func (shareAMI *AWSShareAMI) waitReplicas(imagesByGroup ImagesByGroup, region string) {
+	for _, imagesByRegion := range imagesByGroup {
+		for _, image := range imagesByRegion[region] {
+			if done, ok := shareAMI.replicated[replicaKey(region, image.String())]; ok && image.Region() != region {
+				<-done
+			}
+		}
+	}
+}
+
+// Copy an AMI in two phases, and return the ID of the copy and the number of retries. Only starting the copy
+// is retried with the same client token, so a retry never starts a second copy. Completing the copy is retried
+// against its ID. The ID is journaled once the copy is started, so a resumed apply completes the copy instead of copying again.
+// Starting the copy is never canceled, but waiting for it is: an interrupted copy is skipped, and left to a resumed apply
+func (shareAMI *AWSShareAMI) runCopy(ctx context.Context, action ActionError, step string, started JournalEntry,
+	start func(context.Context, string) (string, error), complete func(context.Context, string) error) (string, int, error) {
+	var id string
+	if shareAMI.journal != nil {
+		if entry, ok := shareAMI.journal.Completed(started); ok {
+			id = entry.ID
+		}
+	}
+
+	retries := 0
+	if id == "" {
+		clientToken := newClientToken(started)
+		var err error
+		retries, err = shareAMI.withRetries(ctx, action, step, func(ctx context.Context) error {
+			var err error
+			id, err = start(ctx, clientToken)
+			return err
+		})
+		if err != nil {
+			return "", retries, err
+		}
+		started.ID = id
+		shareAMI.recordStep(started)
+	}
+
+	completeRetries, err := shareAMI.retryStep(ctx, action, step, func() error {
+		return complete(ctx, id)
+	})
+	if err != nil && shareAMI.interrupted(ctx) {
+		shareAMI.logger.Warnf("Stopped waiting for copy [%s] of AMI [%s]: apply interrupted", id, action.AMI)
+		return id, retries + completeRetries, errStepInterrupted
+	}
+	return id, retries + completeRetries, err
+}
+
+// Load a replica made by a previous apply
+func (shareAMI *AWSShareAMI) loadReplica(ctx context.Context, sess *session.Session, id string) (common.Image, error) {
+	images, err := LoadAMIs(ctx, sess, []string{id}, shareAMI.retryCall)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) < 1 {
+		return nil, errors.New(fmt.Sprintf("replica [%s] not found", id))
+	}
+	return images[0], nil
+}
+
+// The image to share in the given region: the image itself, or its replica if it is in another region
+func (shareAMI *AWSShareAMI) RegionalImage(image common.Image, region string) (common.Image, error) {
+	if image.Region() == region {
+		return image, nil
+	}
+	shareAMI.mutex.Lock()
+	defer shareAMI.mutex.Unlock()
+	if replica, ok := shareAMI.replicas[replicaKey(region, image.String())]; ok {
+		return replica, nil
+	}
+	return image, errors.New("AMI was not replicated")
+}
+
+// Meta tag marking an AMI as shared with an account (or organization) alias
+func ShareWithTag(alias string) string {
+	return fmt.Sprintf("%s-%s", ShareWithPrefix, alias)
+}
+
+func replicaKey(region, sourceId string) string {
+	return fmt.Sprintf("%s/%s", region, sourceId)
+}
+
+// Plan the KMS actions giving the account access to the keys encrypting the snapshots of the filtered AMIs
+func (shareAMI *AWSShareAMI) PlanKMSActions(ctx context.Context, imagesToShare ImagesByGroup, account common.Account) ([]KMSAction, error) {
+	mode := shareAMI.ShareParams.KMSAccess
+	if mode == "" || mode == KMSAccessNone {
+		return nil, nil
+	}
+
+	var actions []KMSAction
+	plannedKeys := make(map[string]struct{})
+	for _, imagesByRegion := range imagesToShare {
+		for region, images := range imagesByRegion {
+			for _, image := range images {
+				keys, err := shareAMI.regionalKMSKeys(ctx, image, region)
+				if err != nil {
+					return actions, err
+				}
+				for _, keyArn := range keys {
+					if _, ok := plannedKeys[region+keyArn]; ok {
+						continue
+					}
+					plannedKeys[region+keyArn] = struct{}{}
+
+					var action KMSAction
+					err := shareAMI.retryCall(ctx, fmt.Sprintf("planning access to KMS key %s", keyArn), func(ctx context.Context) (err error) {
+						action, err = PlanKMSAction(ctx, shareAMI.sessionFactory, &shareAMI.ShareParams.Config.SourceAccount,
+							region, keyArn, account.ID, mode)
+						return err
+					})
+					if err != nil {
+						return actions, err
+					}
+					if action.Action == KMSActionMissing || action.Action == KMSActionAWSManaged {
+						shareAMI.logger.Warnf("Account [%s] cannot use KMS key [%s] of AMI [%s]: %s", account.Alias, keyArn, image.String(), action.Action)
+					}
+					actions = append(actions, action)
+				}
+			}
+		}
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].Region+actions[i].KeyARN < actions[j].Region+actions[j].KeyARN
+	})
+	return actions, nil
+}
+
+// KMS keys of the image to share in the region: the keys of the image, or the replica key of the region
+// if the image is not replicated yet
+func (shareAMI *AWSShareAMI) regionalKMSKeys(ctx context.Context, image common.Image, region string) ([]string, error) {
+	if image.Region() == region {
+		var keys []string
+		err := shareAMI.retryCall(ctx, fmt.Sprintf("describing KMS keys of AMI [%s]", image.String()), func(ctx context.Context) (err error) {
+			keys, err = image.KMSKeys(ctx)
+			return err
+		})
+		return keys, err
+	}
+	kmsKeyId, err := replicaKMSKey(image, region, shareAMI.ShareParams.Config.SourceAccount.ReplicaKMSKeys)
+	if kmsKeyId == "" {
+		return nil, err
+	}
+	return []string{kmsKeyId}, nil
+}
+
+// List the filtered AMIs of the selections that are copied into the target account
+func PlanCopies(imagesToShare ImagesByGroup, account common.Account) []AMICopy {
+	var copies []AMICopy
+	for group, selection := range account.AMIs {
+		if !selection.Copy {
+			continue
+		}
+		for region, images := range imagesToShare[group] {
+			for _, image := range images {
+				copies = append(copies, AMICopy{
+					Group:    group,
+					Region:   region,
+					SourceID: image.String(),
+					KMSKeyID: account.CopyKMSKeyID(group),
+				})
+			}
+		}
+	}
+	sort.Slice(copies, func(i, j int) bool {
+		return fmt.Sprint(copies[i].Group, copies[i].Region, copies[i].SourceID) <
+			fmt.Sprint(copies[j].Group, copies[j].Region, copies[j].SourceID)
+	})
+	return copies
+}
+
+// Fill the IDs of the planned copies made by previous applies, looked up in the target account by their lineage tag
+func (shareAMI *AWSShareAMI) FindCopies(ctx context.Context, account *common.Account, copies []AMICopy) error {
+	sourceIdsByRegion := make(map[string][]string)
+	for _, amiCopy := range copies {
+		sourceIdsByRegion[amiCopy.Region] = append(sourceIdsByRegion[amiCopy.Region], amiCopy.SourceID)
+	}
+	for region, sourceIds := range sourceIdsByRegion {
+		sess, err := shareAMI.sessionFactory.GetSession(ctx, AccountSessionKey(account, region))
+		if err != nil {
+			return err
+		}
+		var found map[string]string
+		err = shareAMI.retryCall(ctx, fmt.Sprintf("finding copies in [%s]", region), func(ctx context.Context) (err error) {
+			found, err = ListCopies(ctx, sess, sourceIds)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for i := range copies {
+			if id, ok := found[copies[i].SourceID]; ok && copies[i].Region == region {
+				shareAMI.logger.Infof("Found copy [%s] of AMI [%s] in account [%s] in [%s]", id, copies[i].SourceID, account.ID, region)
+				copies[i].ID = id
+			}
+		}
+	}
+	return nil
+}
+
+func (account *AMISharePlanAccount) FindCopy(group, region, sourceId string) *AMICopy {
+	for i := range account.Copies {
+		amiCopy := &account.Copies[i]
+		if amiCopy.Group == group && amiCopy.Region == region && amiCopy.SourceID == sourceId {
+			return amiCopy
+		}
+	}
 	return nil
 }
+
+// Share the AMIs of all groups in a region with the organization or organizational unit and mark them with post-sharing tags.
+// Tags are not copied since there is no single target account to copy them to
+func (shareAMI *AWSShareAMI) ShareWithOrganization(ctx context.Context, organization AMISharePlanOrganization, region string, share organizationShareFunc) {
+	config := shareAMI.ShareParams.Config
+	for amiGroup, amisByRegion := range organization.AMIs {
+		for _, ami := range amisByRegion[region] {
+			action := ActionError{Target: organization.Alias, TargetID: organization.ARN, Region: region, Group: amiGroup, AMI: ami.String()}
+			ami, err := shareAMI.RegionalImage(ami, region)
+			if err != nil {
+				shareAMI.actionFailed(action, StepFindImage, err)
+				continue
+			}
+			shareAMI.logger.Infof("Sharing AMI %s[%s] with organization [%s] in region [%s]", amiGroup, ami.String(), organization.ARN, region)
+			if !shareAMI.runStep(ctx, action, StepShare, func(ctx context.Context) error {
+				return share(ami, ctx, organization.ARN, shareAMI.ShareParams.ShareSnapshots)
+			}) {
+				continue
+			}
+			shareMetaTags := map[string]string{ShareWithTag(organization.Alias): "1"}
+			shareAMI.runStep(ctx, action, StepMarkerTags, func(ctx context.Context) error {
+				return ami.AddTags(ctx, shareMetaTags, shareAMI.ShareParams.ShareSnapshots)
+			})
+
+			if len(config.SourceAccount.PostShareTags) > 0 {
+				shareAMI.runStep(ctx, action, StepPostShareTags, func(ctx context.Context) error { return ami.AddTags(ctx, config.SourceAccount.PostShareTags, true) })
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/elastic/aws-ami-share/common"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	// Action of a group without any AMI to share in a region
+	ImageActionSkip = "skip"
+
+	colorReset  = "\x1b[0m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+)
+
+type summaryRow struct {
+	Target string
+	Group  string
+	Region string
+	ID     string
+	Name   string
+	Action string
+}
+
+type summaryTotals struct {
+	Shares        int
+	AlreadyShared int
+	Skipped       int
+}
+
+// Print the summary of the plan on the standard output, unless quiet
+func (shareAMI *AWSShareAMI) PrintSummary(plan *AMISharePlan) error {
+	if shareAMI.ShareParams.Quiet {
+		return nil
+	}
+	color := !shareAMI.ShareParams.NoColor && isTerminal(os.Stdout)
+	return WriteSummary(os.Stdout, plan.Document(), color)
+}
+
+// Write a table of the AMIs planned for each target, followed by the totals by target
+func WriteSummary(w io.Writer, document PlanDocument, color bool) error {
+	var rows []summaryRow
+	var targets []string
+	for _, account := range document.TargetAccounts {
+		targets = append(targets, account.Alias)
+		rows = append(rows, summaryRows(account.Alias, account.AMIs)...)
+	}
+	for _, organization := range append(document.TargetOrganizations, document.TargetOrganizationalUnits...) {
+		targets = append(targets, organization.Alias)
+		rows = append(rows, summaryRows(organization.Alias, organization.AMIs)...)
+	}
+
+	var table bytes.Buffer
+	tw := tabwriter.NewWriter(&table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tGROUP\tREGION\tAMI\tNAME\tACTION")
+	for _, row := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", row.Target, row.Group, row.Region, row.ID, row.Name, row.Action)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// Lines are colored once aligned, escape codes would break the alignment
+	scanner := bufio.NewScanner(&table)
+	for i := 0; scanner.Scan(); i++ {
+		line := scanner.Text()
+		if color && i > 0 {
+			line = colorize(line, rows[i-1].Action)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Totals:")
+	for _, target := range targets {
+		var targetRows []summaryRow
+		for _, row := range rows {
+			if row.Target == target {
+				targetRows = append(targetRows, row)
+			}
+		}
+		totals := countActions(targetRows)
+		fmt.Fprintf(w, "  %s: %d to share, %d already shared, %d skipped\n", target,
+			totals.Shares, totals.AlreadyShared, totals.Skipped)
+	}
+	return nil
+}
+
+func summaryRows(target string, described PlanImagesByGroup) []summaryRow {
+	var rows []summaryRow
+	for _, group := range sortedKeys(described) {
+		descriptionsByRegion := described[group]
+		var regions []string
+		for region := range descriptionsByRegion {
+			regions = append(regions, region)
+		}
+		sort.Strings(regions)
+
+		for _, region := range regions {
+			descriptions := descriptionsByRegion[region]
+			if len(descriptions) < 1 {
+				rows = append(rows, summaryRow{Target: target, Group: group, Region: region, ID: "-", Name: "-", Action: ImageActionSkip})
+				continue
+			}
+			for _, description := range descriptions {
+				rows = append(rows, summaryRow{
+					Target: target,
+					Group:  group,
+					Region: region,
+					ID:     description.ID,
+					Name:   description.Name,
+					Action: description.Action,
+				})
+			}
+		}
+	}
+	return rows
+}
+
+func countActions(rows []summaryRow) summaryTotals {
+	var totals summaryTotals
+	for _, row := range rows {
+		switch row.Action {
+		case common.ImageActionShare:
+			totals.Shares++
+		case common.ImageActionAlreadyShared:
+			totals.AlreadyShared++
+		case ImageActionSkip:
+			totals.Skipped++
+		}
+	}
+	return totals
+}
+
+func sortedKeys(described PlanImagesByGroup) []string {
+	var keys []string
+	for key := range described {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func colorize(line, action string) string {
+	switch action {
+	case common.ImageActionShare:
+		return colorGreen + line + colorReset
+	case ImageActionSkip:
+		return colorYellow + line + colorReset
+	}
+	return line
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && !strings.EqualFold(os.Getenv("TERM"), "dumb")
+}
@@ -18,32 +18,84 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
 	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
 )
 
 type SessionKey struct {
 	AccountID  string
 	AssumeRole string
-	Region     string
+	// intermediate roles assumed in order before AssumeRole, separated by spaces
+	Via    string
+	Region string
+	// settings of the role assumption, defaults of the AWS SDK if unset
+	ExternalID     string
+	SessionName    string
+	Duration       time.Duration
+	SourceIdentity string
+	MFASerial      string
+	// credentials the first role is assumed from, the master session if unset
+	Source CredentialSource
+}
+
+// Credentials of an account other than the default credential chain. At most one source is set
+type CredentialSource struct {
+	// shared config profile used as is, without assuming a role
+	Profile string
+	// shared config profile the first role is assumed from
+	BaseProfile string
+	// OIDC token file the first role is assumed with
+	WebIdentityTokenFile string
+	// credentials of the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables
+	Environment bool
 }
 
 // Returns an AWS session by profile name and region
 // Profile name must be present in the credentials file
 // Master session must be initialized to assume roles in other accounts
+// Sessions are safe for concurrent use, and so is GetSession
 type AWSSessionFactory struct {
 	logger        *log.Entry
 	MasterSession *session.Session
-	SessionCache  map[SessionKey]*session.Session
+	// MFA token codes of the roles requiring MFA
+	MFATokens *MFATokenProvider
+	// guarded by cacheMutex
+	SessionCache map[SessionKey]*session.Session
+	// credentials of the assumed roles, shared by the sessions of all regions
+	credentialsCache map[SessionKey]*credentials.Credentials
+	// sessions of the credential sources, in the region of the master session
+	sourceSessions map[CredentialSource]*session.Session
+	// sessions with MFA of the credential sources, by MFA device
+	mfaSessions map[mfaSessionKey]*session.Session
+	// held while getting the session of an MFA device, so its token code is used once
+	mfaLocks   map[mfaSessionKey]*sync.Mutex
+	cacheMutex sync.Mutex
+}
+
+type mfaSessionKey struct {
+	Source    CredentialSource
+	MFASerial string
 }
 
 func NewAWSSessionFactory() *AWSSessionFactory {
 	return &AWSSessionFactory{
-		SessionCache: make(map[SessionKey]*session.Session),
+		SessionCache:     make(map[SessionKey]*session.Session),
+		credentialsCache: make(map[SessionKey]*credentials.Credentials),
+		sourceSessions:   make(map[CredentialSource]*session.Session),
+		mfaSessions:      make(map[mfaSessionKey]*session.Session),
+		mfaLocks:         make(map[mfaSessionKey]*sync.Mutex),
+		MFATokens:        NewMFATokenProvider(""),
 		logger: log.WithFields(log.Fields{
 			"context":   "aws-session-factory",
 			"operation": "session",
@@ -60,7 +112,10 @@ func (sessionFactory *AWSSessionFactory) GenerateMasterSession(sessionKey Sessio
 	return sess, err
 }
 
-func (sessionFactory *AWSSessionFactory) GetSession(sessionKey SessionKey) (*session.Session, error) {
+func (sessionFactory *AWSSessionFactory) GetSession(ctx context.Context, sessionKey SessionKey) (*session.Session, error) {
+	sessionFactory.cacheMutex.Lock()
+	defer sessionFactory.cacheMutex.Unlock()
+
 	var err error
 	sess, ok := sessionFactory.SessionCache[sessionKey]
 	if !ok {
@@ -69,19 +124,243 @@ func (sessionFactory *AWSSessionFactory) GetSession(sessionKey SessionKey) (*ses
 		}
 
 		sessionFactory.logger.Debugf("Generating session: %v", sessionKey)
-		sess, err = session.NewSession(&aws.Config{
-			Region:      aws.String(sessionKey.Region),
-			Credentials: stscreds.NewCredentials(sessionFactory.MasterSession, sessionKey.AssumeRole),
-		})
+		if sessionKey.Source.Profile != "" {
+			sess, err = profileSession(sessionKey.Source.Profile, sessionKey.Region)
+		} else {
+			var creds *credentials.Credentials
+			creds, err = sessionFactory.roleCredentials(ctx, sessionKey)
+			if err != nil {
+				return nil, err
+			}
+			sess, err = session.NewSession(&aws.Config{
+				Region:      aws.String(sessionKey.Region),
+				Credentials: creds,
+			})
+		}
 		if err != nil {
 			return sess, err
 		}
+		// API calls are retried with the retry policy of the config: the SDK retrying them as well would
+		// multiply the attempts. The credentials keep the retries of their session
+		sess = sess.Copy(aws.NewConfig().WithMaxRetries(0))
 		sessionFactory.SessionCache[sessionKey] = sess
 	}
 
 	return sess, err
 }
 
+// Credentials of the role of the session key, whatever the region: a role requiring MFA is assumed once for all regions.
+// Chained roles are assumed from the credentials of the previous role of the chain, which are shared by all the chains
+// going through it. The first role is assumed from the credential source. Must be called with the cache mutex held
+func (sessionFactory *AWSSessionFactory) roleCredentials(ctx context.Context, sessionKey SessionKey) (*credentials.Credentials, error) {
+	roleKey := sessionKey
+	roleKey.Region = ""
+	if creds, ok := sessionFactory.credentialsCache[roleKey]; ok {
+		return creds, nil
+	}
+
+	var creds *credentials.Credentials
+	via := strings.Fields(sessionKey.Via)
+	if len(via) > 0 {
+		// The external ID is the one of the role of the account
+		previous := SessionKey{
+			AssumeRole:     via[len(via)-1],
+			Via:            strings.Join(via[:len(via)-1], " "),
+			SessionName:    sessionKey.SessionName,
+			Duration:       sessionKey.Duration,
+			SourceIdentity: sessionKey.SourceIdentity,
+			MFASerial:      sessionKey.MFASerial,
+			Source:         sessionKey.Source,
+		}
+		previousCreds, err := sessionFactory.roleCredentials(ctx, previous)
+		if err != nil {
+			return nil, err
+		}
+		sessionFactory.logger.Debugf("Chaining role [%s] through %v", sessionKey.AssumeRole, via)
+		parent, err := session.NewSession(&aws.Config{
+			Region:      sessionFactory.MasterSession.Config.Region,
+			Credentials: previousCreds,
+		})
+		if err != nil {
+			return nil, err
+		}
+		creds = stscreds.NewCredentials(parent, sessionKey.AssumeRole, sessionFactory.assumeRoleOptions(sessionKey))
+	} else if sessionKey.Source.WebIdentityTokenFile != "" {
+		// AssumeRoleWithWebIdentity is not signed: the master session only gives the region
+		provider := stscreds.NewWebIdentityRoleProviderWithOptions(sts.New(sessionFactory.MasterSession), sessionKey.AssumeRole,
+			sessionKey.SessionName, stscreds.FetchTokenPath(sessionKey.Source.WebIdentityTokenFile))
+		if sessionKey.Duration > 0 {
+			provider.Duration = sessionKey.Duration
+		}
+		creds = credentials.NewCredentials(provider)
+	} else {
+		parent, err := sessionFactory.sourceSession(sessionKey.Source)
+		if err == nil && sessionKey.MFASerial != "" {
+			parent, err = sessionFactory.mfaSession(ctx, parent, sessionKey.Source, sessionKey.MFASerial)
+		}
+		if err != nil {
+			return nil, err
+		}
+		creds = stscreds.NewCredentials(parent, sessionKey.AssumeRole, sessionFactory.assumeRoleOptions(sessionKey))
+	}
+	sessionFactory.credentialsCache[roleKey] = creds
+	return creds, nil
+}
+
+// Session the first role is assumed from: the master session, unless the account has a credential source.
+// Must be called with the cache mutex held
+func (sessionFactory *AWSSessionFactory) sourceSession(source CredentialSource) (*session.Session, error) {
+	if source.BaseProfile == "" && !source.Environment {
+		return sessionFactory.MasterSession, nil
+	}
+	if sess, ok := sessionFactory.sourceSessions[source]; ok {
+		return sess, nil
+	}
+
+	region := aws.StringValue(sessionFactory.MasterSession.Config.Region)
+	var sess *session.Session
+	var err error
+	if source.BaseProfile != "" {
+		sess, err = profileSession(source.BaseProfile, region)
+	} else {
+		sess, err = session.NewSession(&aws.Config{
+			Region:      aws.String(region),
+			Credentials: credentials.NewEnvCredentials(),
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	sessionFactory.sourceSessions[source] = sess
+	return sess, nil
+}
+
+// Session with the temporary credentials of the source session authenticated with MFA. A token code is used by a
+// single GetSessionToken call per MFA device, and the roles requiring MFA are assumed from its credentials.
+// Must be called with the cache mutex held. The cache mutex is released while the token code is prompted, so only
+// the sessions of the same MFA device wait for it
+func (sessionFactory *AWSSessionFactory) mfaSession(ctx context.Context, source *session.Session, sourceKey CredentialSource, mfaSerial string) (*session.Session, error) {
+	key := mfaSessionKey{Source: sourceKey, MFASerial: mfaSerial}
+	if sess, ok := sessionFactory.mfaSessions[key]; ok {
+		return sess, nil
+	}
+	lock, ok := sessionFactory.mfaLocks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		sessionFactory.mfaLocks[key] = lock
+	}
+
+	sessionFactory.cacheMutex.Unlock()
+	defer sessionFactory.cacheMutex.Lock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Another caller may have got the session while this one waited for the device
+	sessionFactory.cacheMutex.Lock()
+	sess, ok := sessionFactory.mfaSessions[key]
+	sessionFactory.cacheMutex.Unlock()
+	if ok {
+		return sess, nil
+	}
+
+	code, err := sessionFactory.MFATokens.Token(mfaSerial)
+	if err != nil {
+		return nil, err
+	}
+	sessionFactory.logger.Debugf("Getting session token with MFA device [%s]", mfaSerial)
+	output, err := sts.New(source).GetSessionTokenWithContext(ctx, &sts.GetSessionTokenInput{
+		SerialNumber: aws.String(mfaSerial),
+		TokenCode:    aws.String(code),
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to get session token with MFA device [%s]: %v", mfaSerial, err))
+	}
+	sess, err = session.NewSession(&aws.Config{
+		Region: source.Config.Region,
+		Credentials: credentials.NewStaticCredentials(aws.StringValue(output.Credentials.AccessKeyId),
+			aws.StringValue(output.Credentials.SecretAccessKey), aws.StringValue(output.Credentials.SessionToken)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sessionFactory.cacheMutex.Lock()
+	sessionFactory.mfaSessions[key] = sess
+	sessionFactory.cacheMutex.Unlock()
+	return sess, nil
+}
+
+// Session with the credentials of a profile of the shared config and credentials files
+func profileSession(profile, region string) (*session.Session, error) {
+	return session.NewSessionWithOptions(session.Options{
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+		Config:            aws.Config{Region: aws.String(region)},
+	})
+}
+
+// Check that the credentials of a source can be retrieved: a missing profile or environment variable
+// only fails once the credentials are used
+func (sessionFactory *AWSSessionFactory) ValidateCredentialSource(ctx context.Context, source CredentialSource) error {
+	if source.WebIdentityTokenFile != "" {
+		token, err := ioutil.ReadFile(source.WebIdentityTokenFile)
+		if err != nil {
+			return err
+		}
+		if len(strings.TrimSpace(string(token))) == 0 {
+			return errors.New(fmt.Sprintf("web identity token file [%s] is empty", source.WebIdentityTokenFile))
+		}
+		return nil
+	}
+
+	var sess *session.Session
+	var err error
+	if source.Profile != "" {
+		sess, err = profileSession(source.Profile, aws.StringValue(sessionFactory.MasterSession.Config.Region))
+	} else {
+		sessionFactory.cacheMutex.Lock()
+		sess, err = sessionFactory.sourceSession(source)
+		sessionFactory.cacheMutex.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := sess.Config.Credentials.GetWithContext(ctx); err != nil {
+		if profile := source.Profile + source.BaseProfile; profile != "" {
+			return errors.New(fmt.Sprintf("failed to retrieve credentials of profile [%s]: %v", profile, err))
+		}
+		return err
+	}
+	return nil
+}
+
+// The source identity is given to the first role of a chain, the next roles keep it. The first role of a chain requiring
+// MFA is assumed from the session credentials of the MFA device, without a token code
+func (sessionFactory *AWSSessionFactory) assumeRoleOptions(sessionKey SessionKey) func(*stscreds.AssumeRoleProvider) {
+	return func(provider *stscreds.AssumeRoleProvider) {
+		if sessionKey.ExternalID != "" {
+			provider.ExternalID = aws.String(sessionKey.ExternalID)
+		}
+		if sessionKey.SessionName != "" {
+			provider.RoleSessionName = sessionKey.SessionName
+		}
+		if sessionKey.Duration > 0 {
+			provider.Duration = sessionKey.Duration
+		}
+		if sessionKey.Via != "" {
+			return
+		}
+		if sessionKey.SourceIdentity != "" {
+			provider.SourceIdentity = aws.String(sessionKey.SourceIdentity)
+		}
+	}
+}
+
 func (sessionKey SessionKey) String() string {
+	if sessionKey.Source.Profile != "" {
+		return fmt.Sprintf("%s in %s with profile [%s]", sessionKey.AccountID, sessionKey.Region, sessionKey.Source.Profile)
+	}
+	if sessionKey.Via != "" {
+		return fmt.Sprintf("%s in %s as [%s] via %v", sessionKey.AccountID, sessionKey.Region, sessionKey.AssumeRole, strings.Fields(sessionKey.Via))
+	}
 	return fmt.Sprintf("%s in %s as [%s]", sessionKey.AccountID, sessionKey.Region, sessionKey.AssumeRole)
 }
@@ -0,0 +1,67 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+)
+
+var (
+	mfaTokenPattern = regexp.MustCompile(`^\d{6}$`)
+)
+
+// MFA token codes of the MFA devices. STS rejects a code used twice, so a code is only used once per device,
+// to get the session credentials the roles requiring MFA are assumed from.
+// The code given on the command line is used first, then codes are prompted on stdin
+type MFATokenProvider struct {
+	// guarded by mutex
+	initial string
+	mutex   sync.Mutex
+}
+
+func NewMFATokenProvider(initial string) *MFATokenProvider {
+	return &MFATokenProvider{initial: initial}
+}
+
+// Whether the code has the format of an MFA token code
+func IsMFAToken(code string) bool {
+	return mfaTokenPattern.MatchString(code)
+}
+
+// Token code for the MFA device. Concurrent callers wait for a single prompt at a time
+func (provider *MFATokenProvider) Token(serialNumber string) (string, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	code := provider.initial
+	provider.initial = ""
+	if code == "" {
+		fmt.Fprintf(os.Stderr, "MFA token code for %s: ", serialNumber)
+		if _, err := fmt.Scanln(&code); err != nil {
+			return "", errors.New(fmt.Sprintf("failed to read MFA token code: %v", err))
+		}
+	}
+	if !IsMFAToken(code) {
+		return "", errors.New(fmt.Sprintf("invalid MFA token code for %s: expected 6 digits", serialNumber))
+	}
+	return code, nil
+}